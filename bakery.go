@@ -0,0 +1,267 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/box"
+	errgo "gopkg.in/errgo.v1"
+)
+
+// CaveatIdFormat specifies how the id of a third party caveat
+// (and of the discharge macaroon that discharges it) is made from
+// the caveat's condition and root key.
+type CaveatIdFormat string
+
+const (
+	// CaveatIdPlain uses the condition itself as the caveat id.
+	CaveatIdPlain CaveatIdFormat = ""
+
+	// CaveatIdBakeryV1 encrypts the condition and root key to the
+	// third party in the base64-encoded JSON format used by
+	// version 1 of the macaroon bakery.
+	CaveatIdBakeryV1 CaveatIdFormat = "bakery-v1"
+
+	// CaveatIdBakeryV2 uses the binary format used by
+	// version 2 of the macaroon bakery.
+	CaveatIdBakeryV2 CaveatIdFormat = "bakery-v2"
+
+	// CaveatIdBakeryV3 uses the binary format used by
+	// version 3 of the macaroon bakery, which adds a
+	// namespace to the encrypted part. The namespace
+	// is always empty.
+	CaveatIdBakeryV3 CaveatIdFormat = "bakery-v3"
+)
+
+// BakeryKey holds a bakery public key pair.
+type BakeryKey struct {
+	Public  [32]byte
+	Private [32]byte
+}
+
+var (
+	// FirstPartyKey holds the key of the first party
+	// that creates bakery-format caveat ids.
+	FirstPartyKey = newBakeryKey("first party")
+
+	// ThirdPartyKey holds the key of the third party
+	// that bakery-format caveat ids are encrypted for.
+	ThirdPartyKey = newBakeryKey("third party")
+)
+
+// newBakeryKey returns a key pair derived from the given seed,
+// so that caveat ids are the same each time they are encoded.
+func newBakeryKey(seed string) *BakeryKey {
+	sum := sha256.Sum256([]byte("macarooncompat " + seed))
+	pub, priv, err := box.GenerateKey(bytes.NewReader(sum[:]))
+	if err != nil {
+		panic(err)
+	}
+	return &BakeryKey{
+		Public:  *pub,
+		Private: *priv,
+	}
+}
+
+// bakeryKeyPrefixLen holds the number of bytes of the third
+// party public key included in binary caveat ids.
+const bakeryKeyPrefixLen = 4
+
+// bakeryCaveatIdJSON holds the JSON form of a version 1
+// bakery caveat id before base64 encoding.
+type bakeryCaveatIdJSON struct {
+	ThirdPartyPublicKey []byte
+	FirstPartyPublicKey []byte
+	Nonce               []byte
+	Id                  string
+}
+
+// bakeryCaveatJSON holds the encrypted part of a version 1
+// bakery caveat id.
+type bakeryCaveatJSON struct {
+	RootKey   []byte
+	Condition string
+}
+
+// EncodeCaveatId returns the caveat id for a third party caveat with
+// the given root key and condition in the given format. Bakery
+// formats are encrypted from FirstPartyKey to ThirdPartyKey with a
+// nonce derived from the root key and condition.
+func EncodeCaveatId(format CaveatIdFormat, rootKey []byte, condition string) ([]byte, error) {
+	if format == CaveatIdPlain {
+		return []byte(condition), nil
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s", format, rootKey, condition)
+	var nonce [24]byte
+	copy(nonce[:], h.Sum(nil))
+	switch format {
+	case CaveatIdBakeryV1:
+		plain, err := json.Marshal(bakeryCaveatJSON{
+			RootKey:   rootKey,
+			Condition: condition,
+		})
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		sealed := box.Seal(nil, plain, &nonce, &ThirdPartyKey.Public, &FirstPartyKey.Private)
+		data, err := json.Marshal(bakeryCaveatIdJSON{
+			ThirdPartyPublicKey: ThirdPartyKey.Public[:],
+			FirstPartyPublicKey: FirstPartyKey.Public[:],
+			Nonce:               nonce[:],
+			Id:                  base64.StdEncoding.EncodeToString(sealed),
+		})
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return []byte(base64.StdEncoding.EncodeToString(data)), nil
+	case CaveatIdBakeryV2, CaveatIdBakeryV3:
+		version := byte(2)
+		if format == CaveatIdBakeryV3 {
+			version = 3
+		}
+		secret := []byte{version}
+		secret = appendUvarint(secret, uint64(len(rootKey)))
+		secret = append(secret, rootKey...)
+		if version >= 3 {
+			// The namespace is empty.
+			secret = appendUvarint(secret, 0)
+		}
+		secret = append(secret, condition...)
+		data := []byte{version}
+		data = append(data, ThirdPartyKey.Public[:bakeryKeyPrefixLen]...)
+		data = append(data, FirstPartyKey.Public[:]...)
+		data = append(data, nonce[:]...)
+		return box.Seal(data, secret, &nonce, &ThirdPartyKey.Public, &FirstPartyKey.Private), nil
+	}
+	return nil, fmt.Errorf("unknown caveat id format %q", format)
+}
+
+// DecodeCaveatId decodes a caveat id as the third party would,
+// returning its format, root key and condition. Ids that are not
+// in a bakery format are returned as plain conditions with a nil
+// root key.
+func DecodeCaveatId(id []byte) (format CaveatIdFormat, rootKey []byte, condition string, err error) {
+	if len(id) == 0 {
+		return CaveatIdPlain, nil, "", nil
+	}
+	switch id[0] {
+	case 2, 3:
+		format = CaveatIdBakeryV2
+		if id[0] == 3 {
+			format = CaveatIdBakeryV3
+		}
+		rootKey, condition, err = decodeCaveatIdV2V3(id)
+		if err != nil {
+			return "", nil, "", errgo.Notef(err, "cannot decode %s caveat id", format)
+		}
+		return format, rootKey, condition, nil
+	case 'e':
+		// The base64 encoding of a JSON object starts with 'e',
+		// but so do many plain conditions, so the id is only
+		// treated as a version 1 id if it decodes to the
+		// expected JSON object.
+		cid, ok := parseCaveatIdV1(id)
+		if !ok {
+			break
+		}
+		rootKey, condition, err = decodeCaveatIdV1(cid)
+		if err != nil {
+			return "", nil, "", errgo.Notef(err, "cannot decode %s caveat id", CaveatIdBakeryV1)
+		}
+		return CaveatIdBakeryV1, rootKey, condition, nil
+	}
+	return CaveatIdPlain, nil, string(id), nil
+}
+
+// parseCaveatIdV1 parses the unencrypted part of a version 1
+// caveat id. It reports false if id is not in that format.
+func parseCaveatIdV1(id []byte) (*bakeryCaveatIdJSON, bool) {
+	data, err := base64.StdEncoding.DecodeString(string(id))
+	if err != nil {
+		return nil, false
+	}
+	var cid bakeryCaveatIdJSON
+	if err := json.Unmarshal(data, &cid); err != nil {
+		return nil, false
+	}
+	if len(cid.ThirdPartyPublicKey) == 0 || len(cid.FirstPartyPublicKey) == 0 || len(cid.Nonce) == 0 || cid.Id == "" {
+		return nil, false
+	}
+	return &cid, true
+}
+
+func decodeCaveatIdV1(cid *bakeryCaveatIdJSON) (rootKey []byte, condition string, err error) {
+	if !bytes.Equal(cid.ThirdPartyPublicKey, ThirdPartyKey.Public[:]) {
+		return nil, "", errgo.New("caveat id encrypted for unknown public key")
+	}
+	var nonce [24]byte
+	var firstPartyPub [32]byte
+	if len(cid.Nonce) != len(nonce) || len(cid.FirstPartyPublicKey) != len(firstPartyPub) {
+		return nil, "", errgo.New("bad nonce or public key length")
+	}
+	copy(nonce[:], cid.Nonce)
+	copy(firstPartyPub[:], cid.FirstPartyPublicKey)
+	sealed, err := base64.StdEncoding.DecodeString(cid.Id)
+	if err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	plain, ok := box.Open(nil, sealed, &nonce, &firstPartyPub, &ThirdPartyKey.Private)
+	if !ok {
+		return nil, "", errgo.New("cannot decrypt caveat id")
+	}
+	var cav bakeryCaveatJSON
+	if err := json.Unmarshal(plain, &cav); err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	return cav.RootKey, cav.Condition, nil
+}
+
+func decodeCaveatIdV2V3(id []byte) (rootKey []byte, condition string, err error) {
+	version := id[0]
+	headerLen := 1 + bakeryKeyPrefixLen + 32 + 24
+	if len(id) < headerLen+box.Overhead {
+		return nil, "", errgo.New("caveat id too short")
+	}
+	if !bytes.Equal(id[1:1+bakeryKeyPrefixLen], ThirdPartyKey.Public[:bakeryKeyPrefixLen]) {
+		return nil, "", errgo.New("caveat id encrypted for unknown public key")
+	}
+	var firstPartyPub [32]byte
+	var nonce [24]byte
+	copy(firstPartyPub[:], id[1+bakeryKeyPrefixLen:])
+	copy(nonce[:], id[1+bakeryKeyPrefixLen+32:])
+	secret, ok := box.Open(nil, id[headerLen:], &nonce, &firstPartyPub, &ThirdPartyKey.Private)
+	if !ok {
+		return nil, "", errgo.New("cannot decrypt caveat id")
+	}
+	if len(secret) < 1 || secret[0] != version {
+		return nil, "", errgo.New("unexpected secret part version")
+	}
+	secret = secret[1:]
+	n, size := binary.Uvarint(secret)
+	if size <= 0 || uint64(len(secret)-size) < n {
+		return nil, "", errgo.New("bad root key length")
+	}
+	rootKey, secret = secret[size:size+int(n)], secret[size+int(n):]
+	if version >= 3 {
+		n, size := binary.Uvarint(secret)
+		if size <= 0 || uint64(len(secret)-size) < n {
+			return nil, "", errgo.New("bad namespace length")
+		}
+		secret = secret[size+int(n):]
+	}
+	return rootKey, string(secret), nil
+}
+
+func appendUvarint(data []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	return append(data, buf[:n]...)
+}
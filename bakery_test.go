@@ -0,0 +1,61 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	mcompat "github.com/go-macaroon/macarooncompat"
+)
+
+type bakerySuite struct{}
+
+var _ = gc.Suite(&bakerySuite{})
+
+var caveatIdFormats = []mcompat.CaveatIdFormat{
+	mcompat.CaveatIdPlain,
+	mcompat.CaveatIdBakeryV1,
+	mcompat.CaveatIdBakeryV2,
+	mcompat.CaveatIdBakeryV3,
+}
+
+func (*bakerySuite) TestCaveatIdRoundTrip(c *gc.C) {
+	for _, format := range caveatIdFormats {
+		c.Logf("format %q", format)
+		id, err := mcompat.EncodeCaveatId(format, []byte("caveat-root-key"), "is-authorized bob")
+		c.Assert(err, gc.IsNil)
+		gotFormat, rootKey, cond, err := mcompat.DecodeCaveatId(id)
+		c.Assert(err, gc.IsNil)
+		c.Assert(gotFormat, gc.Equals, format)
+		c.Assert(cond, gc.Equals, "is-authorized bob")
+		if format == mcompat.CaveatIdPlain {
+			c.Assert(rootKey, gc.IsNil)
+		} else {
+			c.Assert(string(rootKey), gc.Equals, "caveat-root-key")
+		}
+		// Encoding is deterministic so that vectors are repeatable.
+		id1, err := mcompat.EncodeCaveatId(format, []byte("caveat-root-key"), "is-authorized bob")
+		c.Assert(err, gc.IsNil)
+		c.Assert(id1, gc.DeepEquals, id)
+	}
+}
+
+func (*bakerySuite) TestDecodeCorruptCaveatId(c *gc.C) {
+	id, err := mcompat.EncodeCaveatId(mcompat.CaveatIdBakeryV2, []byte("caveat-root-key"), "is-authorized bob")
+	c.Assert(err, gc.IsNil)
+	id[len(id)-1] ^= 1
+	_, _, _, err = mcompat.DecodeCaveatId(id)
+	c.Assert(err, gc.ErrorMatches, `cannot decode bakery-v2 caveat id: cannot decrypt caveat id`)
+}
+
+func (*bakerySuite) TestDecodePlainCaveatIdStartingWithE(c *gc.C) {
+	for _, cond := range []string{"everyone", "email-verified", "e30="} {
+		c.Logf("condition %q", cond)
+		format, rootKey, condition, err := mcompat.DecodeCaveatId([]byte(cond))
+		c.Assert(err, gc.IsNil)
+		c.Assert(format, gc.Equals, mcompat.CaveatIdPlain)
+		c.Assert(rootKey, gc.IsNil)
+		c.Assert(condition, gc.Equals, cond)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+//go:build go1.14
+// +build go1.14
+
+package macarooncompat_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	mcompat "github.com/go-macaroon/macarooncompat"
+)
+
+// benchImpls holds the implementations that are benchmarked.
+// It is set up by availableBenchImpls.
+var benchImpls []mcompat.Impl
+
+func availableBenchImpls(b *testing.B) []mcompat.Impl {
+	if benchImpls != nil {
+		return benchImpls
+	}
+	impls, err := selectedImpls()
+	if err != nil {
+		b.Fatal(err)
+	}
+	var unavailable map[mcompat.Implementation]error
+	benchImpls, unavailable = mcompat.AvailableImplementations(impls)
+	for name, err := range unavailable {
+		b.Logf("skipping unavailable implementation %s: %v", name, err)
+	}
+	return benchImpls
+}
+
+// benchmarkImpls runs f as a sub-benchmark for each available
+// implementation. As well as the usual measurements, it reports the
+// number of interpreter round trips per operation and the time per
+// operation with the round trip overhead subtracted (lib-ns/op), so
+// that implementations that run in an interpreter can be compared
+// with the Go implementations.
+//
+// The setup function is called before the timer is started and
+// returns the function to benchmark.
+func benchmarkImpls(b *testing.B, setup func(b *testing.B, pkg mcompat.Package) func()) {
+	for _, impl := range availableBenchImpls(b) {
+		impl := impl
+		b.Run(string(impl.Name), func(b *testing.B) {
+			overhead, err := mcompat.RoundTripOverhead(impl.Pkg, 100)
+			if err != nil {
+				b.Fatal(err)
+			}
+			f := setup(b, impl.Pkg)
+			b.ResetTimer()
+			roundTrips := mcompat.RoundTrips(impl.Pkg)
+			t0 := time.Now()
+			for i := 0; i < b.N; i++ {
+				f()
+			}
+			elapsed := time.Since(t0)
+			b.StopTimer()
+			perOp := float64(mcompat.RoundTrips(impl.Pkg)-roundTrips) / float64(b.N)
+			b.ReportMetric(perOp, "roundtrips/op")
+			libTime := float64(elapsed)/float64(b.N) - perOp*float64(overhead)
+			if libTime < 0 {
+				libTime = 0
+			}
+			b.ReportMetric(libTime, "lib-ns/op")
+		})
+	}
+}
+
+// benchMacaroon returns a macaroon spec with the given number
+// of first party caveats.
+func benchMacaroon(ncaveats int) mcompat.MacaroonSpec {
+	m := mcompat.MacaroonSpec{
+		RootKey:  "root-key",
+		Id:       "root-id",
+		Location: "http://example.com",
+	}
+	for i := 0; i < ncaveats; i++ {
+		m.Caveats = append(m.Caveats, mcompat.CaveatSpec{
+			Condition: fmt.Sprintf("caveat %d", i),
+		})
+	}
+	return m
+}
+
+// benchDischargeTree returns a primary macaroon and its discharges,
+// where each macaroon with less than the given depth has two third
+// party caveats. All the first party conditions are "ok".
+func benchDischargeTree(depth int) []mcompat.MacaroonSpec {
+	ms := []mcompat.MacaroonSpec{{
+		RootKey: "root-key",
+		Id:      "root-id",
+		Caveats: []mcompat.CaveatSpec{{
+			Condition: "ok",
+		}},
+	}}
+	var add func(parent, depth int)
+	add = func(parent, depth int) {
+		if depth == 0 {
+			return
+		}
+		for i := 0; i < 2; i++ {
+			cav := mcompat.CaveatSpec{
+				Condition: fmt.Sprintf("third party caveat %d", len(ms)),
+				Location:  "http://thirdparty.example.com",
+				RootKey:   fmt.Sprintf("third party key %d", len(ms)),
+			}
+			ms[parent].Caveats = append(ms[parent].Caveats, cav)
+			ms = append(ms, mcompat.MacaroonSpec{
+				RootKey:  cav.RootKey,
+				Id:       cav.Condition,
+				Location: cav.Location,
+				Caveats: []mcompat.CaveatSpec{{
+					Condition: "ok",
+				}},
+			})
+			add(len(ms)-1, depth-1)
+		}
+	}
+	add(0, depth)
+	return ms
+}
+
+// makeBenchMacaroon creates the given macaroon for use by a
+// benchmark. It is freed when the benchmark finishes.
+func makeBenchMacaroon(b *testing.B, pkg mcompat.Package, mspec mcompat.MacaroonSpec) mcompat.Macaroon {
+	m, err := mcompat.MakeMacaroon(pkg, mspec)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(m.Free)
+	return m
+}
+
+// makeBenchMacaroons is like makeBenchMacaroon but creates
+// and binds all the given macaroons with MakeMacaroons.
+func makeBenchMacaroons(b *testing.B, pkg mcompat.Package, mspecs []mcompat.MacaroonSpec) ([]byte, []mcompat.Macaroon) {
+	rootKey, ms, err := mcompat.MakeMacaroons(pkg, mspecs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		mcompat.FreeAll(ms)
+	})
+	return rootKey, ms
+}
+
+// checkBench calls b.Fatal if err is non-nil.
+func checkBench(b *testing.B, err error) {
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkNew(b *testing.B) {
+	benchmarkImpls(b, func(b *testing.B, pkg mcompat.Package) func() {
+		return func() {
+			m, err := pkg.New([]byte("root-key"), "root-id", "http://example.com")
+			checkBench(b, err)
+			m.Free()
+		}
+	})
+}
+
+func BenchmarkWithFirstPartyCaveat(b *testing.B) {
+	benchmarkImpls(b, func(b *testing.B, pkg mcompat.Package) func() {
+		m := makeBenchMacaroon(b, pkg, benchMacaroon(0))
+		return func() {
+			m1, err := m.WithFirstPartyCaveat("caveat")
+			checkBench(b, err)
+			m1.Free()
+		}
+	})
+}
+
+func BenchmarkWithThirdPartyCaveat(b *testing.B) {
+	benchmarkImpls(b, func(b *testing.B, pkg mcompat.Package) func() {
+		m := makeBenchMacaroon(b, pkg, benchMacaroon(0))
+		return func() {
+			m1, err := m.WithThirdPartyCaveat([]byte("third party key"), "caveat", "http://thirdparty.example.com")
+			checkBench(b, err)
+			m1.Free()
+		}
+	})
+}
+
+func BenchmarkBind(b *testing.B) {
+	benchmarkImpls(b, func(b *testing.B, pkg mcompat.Package) func() {
+		_, ms := makeBenchMacaroons(b, pkg, benchDischargeTree(1)[:2])
+		return func() {
+			m, err := ms[1].Bind(ms[0])
+			checkBench(b, err)
+			m.Free()
+		}
+	})
+}
+
+func BenchmarkVerify(b *testing.B) {
+	for _, ncaveats := range []int{0, 10, 100} {
+		conds := make(mcompat.Conditions)
+		for _, cav := range benchMacaroon(ncaveats).Caveats {
+			conds[cav.Condition] = true
+		}
+		b.Run(fmt.Sprintf("caveats-%d", ncaveats), func(b *testing.B) {
+			benchmarkVerify(b, []mcompat.MacaroonSpec{benchMacaroon(ncaveats)}, conds)
+		})
+	}
+	for _, depth := range []int{1, 3} {
+		b.Run(fmt.Sprintf("discharge-tree-%d", depth), func(b *testing.B) {
+			benchmarkVerify(b, benchDischargeTree(depth), mcompat.Conditions{"ok": true})
+		})
+	}
+}
+
+func benchmarkVerify(b *testing.B, mspecs []mcompat.MacaroonSpec, conds mcompat.Conditions) {
+	benchmarkImpls(b, func(b *testing.B, pkg mcompat.Package) func() {
+		rootKey, ms := makeBenchMacaroons(b, pkg, mspecs)
+		return func() {
+			checkBench(b, ms[0].Verify(rootKey, conds, ms[1:]))
+		}
+	})
+}
+
+func BenchmarkMarshalJSON(b *testing.B) {
+	benchmarkImpls(b, func(b *testing.B, pkg mcompat.Package) func() {
+		m := makeBenchMacaroon(b, pkg, benchMacaroon(10))
+		if _, err := m.MarshalJSON(); err != nil {
+			b.Skip(err)
+		}
+		return func() {
+			_, err := m.MarshalJSON()
+			checkBench(b, err)
+		}
+	})
+}
+
+func BenchmarkUnmarshalJSON(b *testing.B) {
+	benchmarkImpls(b, func(b *testing.B, pkg mcompat.Package) func() {
+		data, err := makeBenchMacaroon(b, pkg, benchMacaroon(10)).MarshalJSON()
+		if err != nil {
+			b.Skip(err)
+		}
+		return func() {
+			m, err := pkg.UnmarshalJSON(data)
+			checkBench(b, err)
+			m.Free()
+		}
+	})
+}
+
+func BenchmarkMarshalBinary(b *testing.B) {
+	benchmarkImpls(b, func(b *testing.B, pkg mcompat.Package) func() {
+		m := makeBenchMacaroon(b, pkg, benchMacaroon(10))
+		if _, err := m.MarshalBinary(); err != nil {
+			b.Skip(err)
+		}
+		return func() {
+			_, err := m.MarshalBinary()
+			checkBench(b, err)
+		}
+	})
+}
+
+func BenchmarkUnmarshalBinary(b *testing.B) {
+	benchmarkImpls(b, func(b *testing.B, pkg mcompat.Package) func() {
+		data, err := makeBenchMacaroon(b, pkg, benchMacaroon(10)).MarshalBinary()
+		if err != nil {
+			b.Skip(err)
+		}
+		return func() {
+			m, err := pkg.UnmarshalBinary(data)
+			checkBench(b, err)
+			m.Free()
+		}
+	})
+}
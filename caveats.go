@@ -0,0 +1,156 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// caveatJSON holds a caveat in either the version 1
+// or the version 2 JSON format.
+type caveatJSON struct {
+	// Version 1 fields.
+	CID      *string `json:"cid"`
+	VID      string  `json:"vid"`
+	Location string  `json:"cl"`
+
+	// Version 2 fields.
+	CID2      *string `json:"i"`
+	CID64     string  `json:"i64"`
+	VID2      *string `json:"v"`
+	VID64     string  `json:"v64"`
+	Location2 string  `json:"l"`
+}
+
+// caveatsFromJSON implements Macaroon.Caveats for implementations
+// that have no direct equivalent by reading the caveats from the
+// macaroon's JSON serialization, which may be in either format.
+func caveatsFromJSON(m Macaroon) ([]Caveat, error) {
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot marshal macaroon")
+	}
+	var mjson struct {
+		Caveats  []caveatJSON `json:"caveats"`
+		Caveats2 []caveatJSON `json:"c"`
+	}
+	if err := json.Unmarshal(data, &mjson); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal %q", data)
+	}
+	var caveats []Caveat
+	for _, cjson := range append(mjson.Caveats, mjson.Caveats2...) {
+		cav, err := cjson.caveat()
+		if err != nil {
+			return nil, errgo.Notef(err, "bad caveat in %q", data)
+		}
+		caveats = append(caveats, cav)
+	}
+	return caveats, nil
+}
+
+func (c caveatJSON) caveat() (Caveat, error) {
+	var cav Caveat
+	switch {
+	case c.CID != nil:
+		cav.Id = []byte(*c.CID)
+		cav.Location = c.Location
+		if c.VID != "" {
+			vid, err := decodeBase64(c.VID)
+			if err != nil {
+				return Caveat{}, errgo.Notef(err, "bad verification id")
+			}
+			cav.VerificationId = vid
+		}
+		return cav, nil
+	case c.CID2 != nil:
+		cav.Id = []byte(*c.CID2)
+	case c.CID64 != "":
+		id, err := decodeBase64(c.CID64)
+		if err != nil {
+			return Caveat{}, errgo.Notef(err, "bad caveat id")
+		}
+		cav.Id = id
+	default:
+		return Caveat{}, errgo.New("no caveat id")
+	}
+	cav.Location = c.Location2
+	switch {
+	case c.VID2 != nil:
+		cav.VerificationId = []byte(*c.VID2)
+	case c.VID64 != "":
+		vid, err := decodeBase64(c.VID64)
+		if err != nil {
+			return Caveat{}, errgo.Notef(err, "bad verification id")
+		}
+		cav.VerificationId = vid
+	}
+	return cav, nil
+}
+
+// decodeBase64 decodes s, which may use either the standard
+// or the URL-safe alphabet, with or without padding, as the
+// implementations differ.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	s = strings.NewReplacer("-", "+", "_", "/").Replace(s)
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// RunVerificationIds creates each macaroon in the given vector with
+// each implementation and checks, using the reference implementation,
+// that the verification id of each of its third party caveats holds
+// the caveat root key (as derived by the implementation), encrypted
+// with the signature of the macaroon at the point the caveat was
+// added. This checks that all implementations agree on the
+// secretbox key derivation, nonce and layout of verification ids.
+// As the reference implementation is used as an oracle, results
+// are not compared between implementations.
+func (r *Runner) RunVerificationIds(v VerifyVector) []error {
+	r = r.supporting("vid: "+v.About, v.Macaroons...)
+	r.logf("verification id test: %s", v.About)
+	var errs []error
+	for i, mspec := range v.Macaroons {
+		if !hasThirdPartyCaveat(mspec) {
+			continue
+		}
+		check := fmt.Sprintf("vid: %s (macaroon %d)", v.About, i)
+		for _, impl := range r.Impls {
+			if err := checkImplVerificationIds(impl.Pkg, mspec); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s %v", check, impl.Name, err))
+				r.add(check, impl.Name, Result{
+					Outcome: OutcomeFail,
+					Reason:  err.Error(),
+				})
+				continue
+			}
+			r.add(check, impl.Name, Result{Outcome: OutcomePass})
+		}
+	}
+	return errs
+}
+
+// checkImplVerificationIds creates the given macaroon with
+// the given package and checks its verification ids with
+// checkVerificationIds.
+func checkImplVerificationIds(pkg Package, mspec MacaroonSpec) error {
+	m, err := MakeMacaroon(pkg, mspec)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer m.Free()
+	caveats, err := m.Caveats()
+	if err != nil {
+		return errgo.Notef(err, "cannot get caveats")
+	}
+	mspec, err = resolveIds(mspec)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return checkVerificationIds(mspec, caveats, m.Signature())
+}
@@ -0,0 +1,312 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Checker is used to check first party caveat conditions when
+// verifying a macaroon.
+//
+// As implementations that run in an interpreter cannot call back
+// into Go, a checker must also be expressible as a set of predicates.
+// A condition is satisfied if any of the predicates returned by
+// Predicates is satisfied.
+type Checker interface {
+	// Check returns an error if the given condition
+	// is not satisfied.
+	Check(cond string) error
+
+	// Predicates returns the predicates that
+	// make up the checker.
+	Predicates() []Predicate
+}
+
+// Conditions is a Checker that satisfies exactly those conditions
+// that map to true.
+type Conditions map[string]bool
+
+// Check implements Checker.Check.
+func (c Conditions) Check(cond string) error {
+	if c[cond] {
+		return nil
+	}
+	return fmt.Errorf("condition %q not met", cond)
+}
+
+// Predicates implements Checker.Predicates by returning
+// an exact predicate for each satisfied condition,
+// in sorted order.
+func (c Conditions) Predicates() []Predicate {
+	var preds []Predicate
+	for cond, ok := range c {
+		if ok {
+			preds = append(preds, Predicate{
+				Op:  OpExact,
+				Arg: cond,
+			})
+		}
+	}
+	sort.Slice(preds, func(i, j int) bool {
+		return preds[i].Arg < preds[j].Arg
+	})
+	return preds
+}
+
+// PredicateOp identifies the operation performed by a predicate.
+type PredicateOp string
+
+const (
+	// OpExact is satisfied by a condition equal to
+	// the predicate's argument. It corresponds to
+	// satisfy_exact in libmacaroons and pymacaroons.
+	OpExact PredicateOp = "exact"
+
+	// OpPrefix is satisfied by a condition that starts
+	// with the predicate's argument.
+	OpPrefix PredicateOp = "prefix"
+
+	// OpTimeBefore is satisfied by a condition of the
+	// form "time-before T" where T is a time later than
+	// the time in the predicate's argument. Both times
+	// must be in UTC in the format held in TimeFormat.
+	OpTimeBefore PredicateOp = "time-before"
+
+	// OpTimeLessThan is satisfied by a condition of the form
+	// "time < T", as used in the libmacaroons and pymacaroons
+	// documentation, where T is a time in the format held in
+	// ShortTimeFormat that is later than the time in the
+	// predicate's argument, which is in TimeFormat. Both
+	// times are in UTC.
+	OpTimeLessThan PredicateOp = "time<"
+)
+
+// TimeFormat holds the format of the times used by OpTimeBefore.
+const TimeFormat = "2006-01-02T15:04:05Z"
+
+// ShortTimeFormat holds the format of the times in
+// conditions satisfied by OpTimeLessThan.
+const ShortTimeFormat = "2006-01-02T15:04"
+
+// timePattern matches times in TimeFormat. It is used as
+// well as time.Parse so that all implementations agree
+// on exactly which times are valid.
+var timePattern = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}:[0-9]{2}Z$`)
+
+// shortTimePattern matches times in ShortTimeFormat.
+var shortTimePattern = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}$`)
+
+// Predicate holds a single predicate in a checker. All
+// predicates except OpExact are "general" predicates
+// in libmacaroons and pymacaroons terminology.
+type Predicate struct {
+	Op  PredicateOp `json:"op"`
+	Arg string      `json:"arg"`
+}
+
+// Satisfied reports whether the predicate is
+// satisfied by the given condition.
+func (p Predicate) Satisfied(cond string) bool {
+	switch p.Op {
+	case OpExact:
+		return cond == p.Arg
+	case OpPrefix:
+		return strings.HasPrefix(cond, p.Arg)
+	case OpTimeBefore:
+		if !strings.HasPrefix(cond, "time-before ") {
+			return false
+		}
+		now, ok := parseTime(p.Arg)
+		if !ok {
+			return false
+		}
+		t, ok := parseTime(strings.TrimPrefix(cond, "time-before "))
+		return ok && now.Before(t)
+	case OpTimeLessThan:
+		if !strings.HasPrefix(cond, "time < ") {
+			return false
+		}
+		now, ok := parseTime(p.Arg)
+		if !ok {
+			return false
+		}
+		t, ok := parseShortTime(strings.TrimPrefix(cond, "time < "))
+		return ok && now.Before(t)
+	}
+	return false
+}
+
+// predicatesJSON returns the predicates of the given checker
+// encoded as a JSON array.
+func predicatesJSON(c Checker) string {
+	preds := c.Predicates()
+	if preds == nil {
+		preds = []Predicate{}
+	}
+	data, err := json.Marshal(preds)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+func parseTime(s string) (time.Time, bool) {
+	if !timePattern.MatchString(s) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(TimeFormat, s)
+	return t, err == nil
+}
+
+func parseShortTime(s string) (time.Time, bool) {
+	if !shortTimePattern.MatchString(s) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(ShortTimeFormat, s)
+	return t, err == nil
+}
+
+// Predicates is a Checker that satisfies any condition
+// that satisfies at least one of its predicates.
+type Predicates []Predicate
+
+// Check implements Checker.Check.
+func (ps Predicates) Check(cond string) error {
+	for _, p := range ps {
+		if p.Satisfied(cond) {
+			return nil
+		}
+	}
+	return fmt.Errorf("condition %q not met", cond)
+}
+
+// Predicates implements Checker.Predicates.
+func (ps Predicates) Predicates() []Predicate {
+	return ps
+}
+
+// pyCheckerDef defines checker_verifier, which returns a verifier of
+// the given class that satisfies the given predicates, as decoded from
+// JSON. If a trace list is given, all the predicates are installed as
+// general predicates, preceded by one that appends each condition to
+// the list. It is used by both the libmacaroons and the pymacaroons
+// implementations.
+const pyCheckerDef = `
+global parse_time, general_predicate, checker_verifier
+def parse_time(s, short=False):
+	import datetime, re
+	if short:
+		pattern, layout = r'^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}$', '%Y-%m-%dT%H:%M'
+	else:
+		pattern, layout = r'^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}:[0-9]{2}Z$', '%Y-%m-%dT%H:%M:%SZ'
+	if not re.match(pattern, s):
+		return None
+	try:
+		return datetime.datetime.strptime(s, layout)
+	except ValueError:
+		return None
+
+def general_predicate(p):
+	op, arg = p['op'], p['arg']
+	def check(cond):
+		if op == 'exact':
+			return cond == arg
+		if op == 'prefix':
+			return cond.startswith(arg)
+		if op == 'time-before':
+			if not cond.startswith('time-before '):
+				return False
+			now, t = parse_time(arg), parse_time(cond[len('time-before '):])
+			return now is not None and t is not None and now < t
+		if op == 'time<':
+			if not cond.startswith('time < '):
+				return False
+			now, t = parse_time(arg), parse_time(cond[len('time < '):], short=True)
+			return now is not None and t is not None and now < t
+		return False
+	return check
+
+def checker_verifier(verifier_class, preds, trace=None):
+	v = verifier_class()
+	if trace is not None:
+		def record(cond):
+			if isinstance(cond, bytes) and not isinstance(cond, str):
+				cond = cond.decode('utf-8')
+			trace.append(cond)
+			return False
+		v.satisfy_general(record)
+	for p in preds:
+		if p['op'] == 'exact' and trace is None:
+			v.satisfy_exact(p['arg'])
+		else:
+			v.satisfy_general(general_predicate(p))
+	return v
+`
+
+// jsCheckerDef defines state.checkerFunc, which returns a check
+// function for the macaroon package's verify method that satisfies
+// the given predicates.
+const jsCheckerDef = `state.checkerFunc = function(preds) {
+	var parseTime = function(s) {
+		var t;
+		if(!/^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}:[0-9]{2}Z$/.test(s)){
+			return null;
+		}
+		t = Date.parse(s);
+		if(isNaN(t) || new Date(t).toISOString().slice(0, 19) + "Z" !== s){
+			return null;
+		}
+		return t;
+	};
+	var parseShortTime = function(s) {
+		var t;
+		if(!/^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}$/.test(s)){
+			return null;
+		}
+		t = Date.parse(s + ":00Z");
+		if(isNaN(t) || new Date(t).toISOString().slice(0, 16) !== s){
+			return null;
+		}
+		return t;
+	};
+	var satisfied = function(p, cond) {
+		var now, t;
+		switch(p.op){
+		case "exact":
+			return cond === p.arg;
+		case "prefix":
+			return cond.indexOf(p.arg) === 0;
+		case "time-before":
+			if(cond.indexOf("time-before ") !== 0){
+				return false;
+			}
+			now = parseTime(p.arg);
+			t = parseTime(cond.slice("time-before ".length));
+			return now !== null && t !== null && now < t;
+		case "time<":
+			if(cond.indexOf("time < ") !== 0){
+				return false;
+			}
+			now = parseTime(p.arg);
+			t = parseShortTime(cond.slice("time < ".length));
+			return now !== null && t !== null && now < t;
+		}
+		return false;
+	};
+	return function(cond) {
+		var i;
+		for(i = 0; i < preds.length; i++){
+			if(satisfied(preds[i], cond)){
+				return null;
+			}
+		}
+		return new Error("condition not satisfied");
+	};
+}`
@@ -0,0 +1,142 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	mcompat "github.com/go-macaroon/macarooncompat"
+)
+
+type checkerSuite struct{}
+
+var _ = gc.Suite(&checkerSuite{})
+
+var predicateSatisfiedTests = []struct {
+	pred   mcompat.Predicate
+	cond   string
+	expect bool
+}{{
+	pred:   mcompat.Predicate{Op: mcompat.OpExact, Arg: "a"},
+	cond:   "a",
+	expect: true,
+}, {
+	pred: mcompat.Predicate{Op: mcompat.OpExact, Arg: "a"},
+	cond: "a ",
+}, {
+	pred:   mcompat.Predicate{Op: mcompat.OpPrefix, Arg: "op "},
+	cond:   "op read",
+	expect: true,
+}, {
+	pred: mcompat.Predicate{Op: mcompat.OpPrefix, Arg: "op "},
+	cond: "op",
+}, {
+	pred:   mcompat.Predicate{Op: mcompat.OpTimeBefore, Arg: "2020-06-01T12:00:00Z"},
+	cond:   "time-before 2020-06-01T12:00:01Z",
+	expect: true,
+}, {
+	pred: mcompat.Predicate{Op: mcompat.OpTimeBefore, Arg: "2020-06-01T12:00:00Z"},
+	cond: "time-before 2020-06-01T12:00:00Z",
+}, {
+	pred: mcompat.Predicate{Op: mcompat.OpTimeBefore, Arg: "2020-06-01T12:00:00Z"},
+	cond: "time-before 2030-02-30T00:00:00Z",
+}, {
+	pred: mcompat.Predicate{Op: mcompat.OpTimeBefore, Arg: "2020-06-01T12:00:00Z"},
+	cond: "time-before 2030-01-01T00:00Z",
+}, {
+	pred: mcompat.Predicate{Op: mcompat.OpTimeBefore, Arg: "2020-06-01T12:00:00Z"},
+	cond: "time-before 2030-01-01T00:00:00+00:00",
+}, {
+	pred: mcompat.Predicate{Op: mcompat.OpTimeBefore, Arg: "2020-06-01T12:00:00Z"},
+	cond: "time < 2030-01-01T00:00:00Z",
+}, {
+	pred:   mcompat.Predicate{Op: mcompat.OpTimeLessThan, Arg: "2014-06-01T12:00:00Z"},
+	cond:   "time < 2015-01-01T00:00",
+	expect: true,
+}, {
+	pred: mcompat.Predicate{Op: mcompat.OpTimeLessThan, Arg: "2015-01-01T00:00:00Z"},
+	cond: "time < 2015-01-01T00:00",
+}, {
+	pred: mcompat.Predicate{Op: mcompat.OpTimeLessThan, Arg: "2014-06-01T12:00:00Z"},
+	cond: "time < 2015-02-30T00:00",
+}, {
+	pred: mcompat.Predicate{Op: mcompat.OpTimeLessThan, Arg: "2014-06-01T12:00:00Z"},
+	cond: "time < 2015-01-01T00:00:00Z",
+}, {
+	pred: mcompat.Predicate{Op: mcompat.OpTimeLessThan, Arg: "2014-06-01T12:00:00Z"},
+	cond: "time-before 2015-01-01T00:00:00Z",
+}, {
+	pred: mcompat.Predicate{Op: "unknown", Arg: "a"},
+	cond: "a",
+}}
+
+func (*checkerSuite) TestPredicateSatisfied(c *gc.C) {
+	for i, test := range predicateSatisfiedTests {
+		c.Logf("test %d: %#v %q", i, test.pred, test.cond)
+		c.Check(test.pred.Satisfied(test.cond), gc.Equals, test.expect)
+	}
+}
+
+func (*checkerSuite) TestConditionsPredicates(c *gc.C) {
+	conds := mcompat.Conditions{"b": true, "a": true, "c": false}
+	c.Assert(conds.Predicates(), gc.DeepEquals, []mcompat.Predicate{
+		{Op: mcompat.OpExact, Arg: "a"},
+		{Op: mcompat.OpExact, Arg: "b"},
+	})
+	c.Assert(conds.Check("a"), gc.IsNil)
+	c.Assert(conds.Check("c"), gc.ErrorMatches, `condition "c" not met`)
+}
+
+func (*checkerSuite) TestVerifyCheckChecker(c *gc.C) {
+	check := mcompat.VerifyCheck{
+		Conditions: mcompat.Conditions{"a": true},
+		Predicates: mcompat.Predicates{{Op: mcompat.OpPrefix, Arg: "op "}},
+	}
+	checker := check.Checker()
+	c.Assert(checker.Check("a"), gc.IsNil)
+	c.Assert(checker.Check("op write"), gc.IsNil)
+	c.Assert(checker.Check("b"), gc.ErrorMatches, `condition "b" not met`)
+}
+
+func (*checkerSuite) TestVerifyTrace(c *gc.C) {
+	tested := 0
+	for _, name := range []mcompat.Implementation{mcompat.ImplGoV1, mcompat.ImplGoV2} {
+		impl, ok := testImpl(c, name)
+		if !ok {
+			continue
+		}
+		tested++
+		c.Logf("implementation %s", impl.Name)
+		rootKey, ms, err := mcompat.MakeMacaroons(impl.Pkg, []mcompat.MacaroonSpec{{
+			RootKey: "root-key",
+			Id:      "root-id",
+			Caveats: []mcompat.CaveatSpec{{
+				Condition: "a",
+			}, {
+				Condition: "tp",
+				Location:  "tp-loc",
+				RootKey:   "tp-key",
+			}, {
+				Condition: "b",
+			}},
+		}, {
+			RootKey: "tp-key",
+			Id:      "tp",
+			Caveats: []mcompat.CaveatSpec{{
+				Condition: "c",
+			}},
+		}})
+		c.Assert(err, gc.IsNil)
+		trace, err := mcompat.VerifyTrace(ms[0], rootKey, mcompat.Conditions{"a": true, "b": true, "c": true}, ms[1:])
+		c.Assert(err, gc.IsNil)
+		c.Assert(trace, gc.DeepEquals, []string{"a", "c", "b"})
+		trace, err = mcompat.VerifyTrace(ms[0], rootKey, mcompat.Conditions{"b": true, "c": true}, ms[1:])
+		c.Assert(err, gc.ErrorMatches, `.*condition "a" not met`)
+		c.Assert(trace, gc.DeepEquals, []string{"a"})
+		mcompat.FreeAll(ms)
+	}
+	if tested == 0 {
+		c.Skip("no Go implementation selected")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+// The macarooncompat command runs the macaroon compatibility
+// test vectors against all the available implementations
+// and prints a report of the results.
+//
+// It must be run from the root of the macarooncompat
+// repository (or with the -dir flag pointing to it), because
+// the interpreters for the non-Go implementations are found
+// relative to that directory.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	mcompat "github.com/go-macaroon/macarooncompat"
+)
+
+var (
+	dirFlag          = flag.String("dir", "", "change to the given directory (the root of the macarooncompat repository) before running")
+	implsFlag        = flag.String("impls", "", "comma-separated list of implementations to test (default all)")
+	excludeImplsFlag = flag.String("exclude-impls", "", "comma-separated list of implementations not to test")
+	vectorsFlag      = flag.String("vectors", "", "only use test vectors with descriptions matching this regular expression")
+	corpusFlag       = flag.String("corpus", "testdata/vectors", "directory holding the test vector corpus")
+	reportFlag       = flag.String("report", "", "comma-separated list of files to write the report to (.json, .md or .html); by default it is printed to stdout as Markdown")
+	recordFlag       = flag.String("record", "", "record interpreter sessions into the given directory")
+	replayFlag       = flag.String("replay", "", "replay interpreter sessions from the given directory instead of running the interpreters")
+	verboseFlag      = flag.Bool("v", false, "log progress to stderr")
+	shrinkFlag       = flag.String("shrink", "", "instead of running the corpus, shrink the verify vectors in the given corpus file on which the two selected implementations disagree and print the results as a corpus")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: macarooncompat [flags]\n")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+	}
+	failures, err := run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "macarooncompat: %v\n", err)
+		os.Exit(2)
+	}
+	if failures > 0 {
+		fmt.Fprintf(os.Stderr, "macarooncompat: %d failures\n", failures)
+		os.Exit(1)
+	}
+}
+
+// run runs the compatibility checks and returns the
+// number of failures in the resulting report.
+func run() (int, error) {
+	if *dirFlag != "" {
+		if err := os.Chdir(*dirFlag); err != nil {
+			return 0, err
+		}
+	}
+	switch {
+	case *recordFlag != "" && *replayFlag != "":
+		return 0, fmt.Errorf("cannot specify both -record and -replay")
+	case *recordFlag != "":
+		mcompat.SetSessionMode(mcompat.SessionRecord, *recordFlag)
+		defer mcompat.CloseSessions()
+	case *replayFlag != "":
+		mcompat.SetSessionMode(mcompat.SessionReplay, *replayFlag)
+	}
+	vectors, err := regexp.Compile(*vectorsFlag)
+	if err != nil {
+		return 0, fmt.Errorf("bad -vectors flag: %v", err)
+	}
+	corpus, err := mcompat.LoadCorpus(*corpusFlag)
+	if err != nil {
+		return 0, err
+	}
+	impls, err := mcompat.SelectImplementations(
+		mcompat.ParseImplementations(*implsFlag),
+		mcompat.ParseImplementations(*excludeImplsFlag),
+	)
+	if err != nil {
+		return 0, err
+	}
+	runner, err := mcompat.NewRunner(impls)
+	if err != nil {
+		return 0, err
+	}
+	for _, impl := range impls {
+		if err := runner.Unavailable[impl.Name]; err != nil {
+			fmt.Fprintf(os.Stderr, "skipping unavailable implementation %s: %v\n", impl.Name, err)
+		}
+	}
+	if len(runner.Impls) == 0 {
+		return 0, fmt.Errorf("no implementations available")
+	}
+	if *verboseFlag {
+		runner.Logf = func(f string, a ...interface{}) {
+			fmt.Fprintf(os.Stderr, f+"\n", a...)
+		}
+	}
+	defer mcompat.UseDeterministicNonces()()
+	if *shrinkFlag != "" {
+		return 0, shrink(runner, *shrinkFlag)
+	}
+	errs := runner.RunCorpus(corpus, vectors.MatchString)
+	if *verboseFlag {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+	if *reportFlag == "" {
+		if err := runner.Report.WriteMarkdown(os.Stdout); err != nil {
+			return 0, err
+		}
+	} else {
+		for _, path := range strings.Split(*reportFlag, ",") {
+			if err := runner.Report.WriteFile(path); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return runner.Report.Failures(), nil
+}
+
+// shrink shrinks all the verify vectors in the given corpus file
+// on which the runner's two implementations disagree and
+// prints the result to stdout.
+func shrink(runner *mcompat.Runner, path string) error {
+	if len(runner.Impls) != 2 {
+		return fmt.Errorf("-shrink requires exactly two implementations")
+	}
+	corpus, err := mcompat.ReadCorpusFile(path)
+	if err != nil {
+		return err
+	}
+	var shrunk mcompat.Corpus
+	for _, v := range corpus.Verify {
+		v, err := runner.Shrink(v, runner.Impls[0].Name, runner.Impls[1].Name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			continue
+		}
+		shrunk.Verify = append(shrunk.Verify, v)
+	}
+	return mcompat.WriteCorpus(os.Stdout, &shrunk)
+}
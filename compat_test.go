@@ -4,21 +4,52 @@
 package macarooncompat_test
 
 import (
-	"crypto/rand"
-	"encoding/json"
+	"encoding/hex"
+	"flag"
 	"fmt"
-	"io"
+	"os"
+	"regexp"
 	"testing"
 
-	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/macaroon.v1"
 
 	mcompat "github.com/go-macaroon/macarooncompat"
 )
 
+var (
+	recordSessions = flag.String("record", "", "record interpreter sessions into the given directory")
+	replaySessions = flag.String("replay", "", "replay interpreter sessions from the given directory instead of running the interpreters")
+	implsFlag      = flag.String("impls", "", "comma-separated list of implementations to test (default all, or $"+implsEnvVar+")")
+	excludeImpls   = flag.String("exclude-impls", "", "comma-separated list of implementations not to test")
+	vectorsFlag    = flag.String("vectors", "", "only use test vectors with descriptions matching this regular expression")
+	corpusFlag     = flag.String("corpus", "testdata/vectors", "directory holding the test vector corpus")
+	reportFlag     = flag.String("report", "", "write a compatibility report to the given file (.json, .md or .html)")
+	stressFlag     = flag.Bool("stress", false, "run the stress tests")
+)
+
+// implsEnvVar holds the name of the environment variable that
+// can be used to select a comma-separated subset of the
+// implementations to test.
+const implsEnvVar = "MACAROONCOMPAT_IMPLS"
+
+// testRunner holds the runner used to run compatibility checks
+// against the selected implementations that are available.
+// It is set up by SetUpSuite.
+var testRunner *mcompat.Runner
+
+// testImpls holds the implementations that are tested.
+var testImpls []mcompat.Impl
+
+// testVectors holds the pattern that test vector descriptions
+// must match to be used. It is set up by SetUpSuite.
+var testVectors *regexp.Regexp
+
+// testCorpus holds the test vectors. It is loaded by SetUpSuite.
+var testCorpus *mcompat.Corpus
+
 type suite struct {
-	origRandReader io.Reader
+	restoreNonces func()
 }
 
 var _ = gc.Suite(&suite{})
@@ -28,644 +59,249 @@ func TestPackage(t *testing.T) {
 }
 
 func (s *suite) SetUpSuite(c *gc.C) {
-	s.origRandReader = rand.Reader
-}
-
-func (s *suite) TearDownSuite(c *gc.C) {
-	rand.Reader = s.origRandReader
-}
-
-func (s *suite) SetUpTest(c *gc.C) {
-	// Patch rand.Reader so that the encryption used by the
-	// macaroon package will be deterministic. Without this,
+	// Use deterministic nonces so that the encryption used by
+	// the macaroon package will be deterministic. Without this,
 	// signatures produced when adding third party caveats will
 	// not be deterministic, because they include a random nonce.
 	//
 	// When libmacaroons is changed to use a random
 	// source for encryption, that will need patching too.
-	rand.Reader = zeroReader{}
+	s.restoreNonces = mcompat.UseDeterministicNonces()
+	switch {
+	case *recordSessions != "" && *replaySessions != "":
+		c.Fatalf("cannot specify both -record and -replay")
+	case *recordSessions != "":
+		mcompat.SetSessionMode(mcompat.SessionRecord, *recordSessions)
+	case *replaySessions != "":
+		mcompat.SetSessionMode(mcompat.SessionReplay, *replaySessions)
+	}
+	impls, err := selectedImpls()
+	c.Assert(err, gc.IsNil)
+	testRunner, err = mcompat.NewRunner(impls)
+	c.Assert(err, gc.IsNil)
+	for _, impl := range impls {
+		if err := testRunner.Unavailable[impl.Name]; err != nil {
+			fmt.Fprintf(os.Stderr, "skipping unavailable implementation %s: %v\n", impl.Name, err)
+		}
+	}
+	testImpls = testRunner.Impls
+	if len(testImpls) == 0 {
+		c.Fatalf("no implementations available")
+	}
+	testVectors, err = regexp.Compile(*vectorsFlag)
+	c.Assert(err, gc.IsNil, gc.Commentf("bad -vectors flag"))
+	testCorpus, err = mcompat.LoadCorpus(*corpusFlag)
+	c.Assert(err, gc.IsNil)
 }
 
-var signatureTests = []struct {
-	about           string
-	macaroon        macaroonSpec
-	exclude         exclude
-	expectSignature string
-}{{
-	about: "no caveats, from libmacaroons example",
-	macaroon: macaroonSpec{
-		rootKey:  "this is our super secret key; only we should know it",
-		id:       "we used our secret key",
-		location: "http://mybank",
-	},
-	expectSignature: "e3d9e02908526c4c0039ae15114115d97fdd68bf2ba379b342aaf0f617d0552f",
-}, {
-	about: "one caveat, from libmacaroons example",
-	macaroon: macaroonSpec{
-		rootKey:  "this is our super secret key; only we should know it",
-		id:       "we used our secret key",
-		location: "http://mybank",
-		caveats: []caveat{{
-			condition: "account = 3735928559",
-		}},
-	},
-	expectSignature: "1efe4763f290dbce0c1d08477367e11f4eee456a64933cf662d79772dbb82128",
-}, {
-	about: "two caveats, from libmacaroons example",
-	macaroon: macaroonSpec{
-		rootKey:  "this is our super secret key; only we should know it",
-		id:       "we used our secret key",
-		location: "http://mybank",
-		caveats: []caveat{{
-			condition: "account = 3735928559",
-		}, {
-			condition: "time < 2015-01-01T00:00",
-		}},
-	},
-	expectSignature: "696665d0229f9f801b588bb3f68bbdb806b26d1fbcd40ca22d9017bce4a075f1",
-}, {
-	about: "three caveats, from libmacaroons example",
-	macaroon: macaroonSpec{
-		rootKey:  "this is our super secret key; only we should know it",
-		id:       "we used our secret key",
-		location: "http://mybank",
-		caveats: []caveat{{
-			condition: "account = 3735928559",
-		}, {
-			condition: "time < 2015-01-01T00:00",
-		}, {
-			condition: "email = alice@example.org",
-		}},
-	},
-	expectSignature: "882e6d59496ed5245edb7ab5b8839ecd63e5d504e54839804f164070d8eed952",
-}, {
-	about: "one caveat, from second libmacaroons example",
-	macaroon: macaroonSpec{
-		rootKey:  "this is a different super-secret key; never use the same secret twice",
-		id:       "we used our other secret key",
-		location: "http://mybank",
-		caveats: []caveat{{
-			condition: "account = 3735928559",
-		}},
-	},
-	expectSignature: "1434e674ad84fdfdc9bc1aa00785325c8b6d57341fc7ce200ba4680c80786dda",
-}, {
-	about: "one 3rd party caveat, from second libmacaroons example",
-	macaroon: macaroonSpec{
-		rootKey:  "this is a different super-secret key; never use the same secret twice",
-		id:       "we used our other secret key",
-		location: "http://mybank",
-		caveats: []caveat{{
-			condition: "account = 3735928559",
-		}, {
-			rootKey:   "4; guaranteed random by a fair toss of the dice",
-			condition: "this was how we remind auth of key/pred",
-			location:  "http://auth.mybank/",
-		}},
-	},
-	exclude: exclude{
-		mcompat.ImplLibMacaroons2: `cannot fake random nonce generator`,
-	},
-	expectSignature: "d27db2fd1f22760e4c3dae8137e2d8fc1df6c0741c18aed4b97256bf78d1f55c",
-}}
+// selectedImpls returns the implementations selected
+// by the command line flags or the environment.
+func selectedImpls() ([]mcompat.Impl, error) {
+	include := *implsFlag
+	if include == "" {
+		include = os.Getenv(implsEnvVar)
+	}
+	return mcompat.SelectImplementations(
+		mcompat.ParseImplementations(include),
+		mcompat.ParseImplementations(*excludeImpls),
+	)
+}
+
+// testImpl returns the implementation with the given name
+// if it is selected by the -impls and -exclude-impls flags
+// and is available.
+func testImpl(c *gc.C, name mcompat.Implementation) (mcompat.Impl, bool) {
+	impls, err := selectedImpls()
+	c.Assert(err, gc.IsNil)
+	for _, impl := range impls {
+		if impl.Name == name {
+			return impl, impl.Pkg.Available() == nil
+		}
+	}
+	return mcompat.Impl{}, false
+}
+
+func (s *suite) TearDownSuite(c *gc.C) {
+	s.restoreNonces()
+	c.Check(mcompat.CloseSessions(), gc.IsNil)
+	if *reportFlag != "" && testRunner != nil {
+		err := testRunner.Report.WriteFile(*reportFlag)
+		c.Check(err, gc.IsNil)
+	}
+}
+
+func (s *suite) SetUpTest(c *gc.C) {
+	testRunner.Logf = c.Logf
+}
 
 func (*suite) TestSignature(c *gc.C) {
-	for i, test := range signatureTests {
-		c.Logf("test %d: %s", i, test.about)
-		checkConsistency(c, func(pkg mcompat.Package) (interface{}, error) {
-			m := makeMacaroon(pkg, test.macaroon)
-			if test.expectSignature != "" {
-				c.Check(fmt.Sprintf("%x", m.Signature()), gc.Equals, test.expectSignature)
-			}
-			return m.Signature(), nil
-		}, test.exclude)
+	for i, test := range testCorpus.Signature {
+		if !testVectors.MatchString(test.About) {
+			continue
+		}
+		c.Logf("test %d: %s", i, test.About)
+		checkErrors(c, testRunner.RunSignature(test))
 	}
 }
 
 func (*suite) TestBind(c *gc.C) {
-	checkConsistency(c, func(pkg mcompat.Package) (interface{}, error) {
-		_, macaroons := makeMacaroons(pkg, []macaroonSpec{{
-			rootKey:  "this is a different super-secret key; never use the same secret twice",
-			id:       "we used our other secret key",
-			location: "http://mybank",
-			caveats: []caveat{{
-				condition: "account = 3735928559",
+	const about = "bind: libmacaroons example 2"
+	if !testVectors.MatchString(about) {
+		c.Skip("excluded by -vectors")
+	}
+	// example 2 from libmacaroons README
+	expectSig, err := hex.DecodeString("2eb01d0dd2b4475330739140188648cf25dda0425ea9f661f1574ca0a9eac54e")
+	c.Assert(err, gc.IsNil)
+	_, errs := testRunner.CheckConsistency(about, []mcompat.Behaviour{mcompat.BehaviourRandomNonce}, expectSig, func(pkg mcompat.Package) (interface{}, error) {
+		_, macaroons := makeMacaroons(pkg, []mcompat.MacaroonSpec{{
+			RootKey:  "this is a different super-secret key; never use the same secret twice",
+			Id:       "we used our other secret key",
+			Location: "http://mybank",
+			Caveats: []mcompat.CaveatSpec{{
+				Condition: "account = 3735928559",
 			}, {
-				rootKey:   "4; guaranteed random by a fair toss of the dice",
-				condition: "this was how we remind auth of key/pred",
-				location:  "http://auth.mybank/",
+				RootKey:   "4; guaranteed random by a fair toss of the dice",
+				Condition: "this was how we remind auth of key/pred",
+				Location:  "http://auth.mybank/",
 			}},
 		}, {
-			rootKey: "4; guaranteed random by a fair toss of the dice",
-			id:      "this was how we remind auth of key/pred",
-			caveats: []caveat{{
-				condition: "time < 2015-01-01T00:00",
+			RootKey: "4; guaranteed random by a fair toss of the dice",
+			Id:      "this was how we remind auth of key/pred",
+			Caveats: []mcompat.CaveatSpec{{
+				Condition: "time < 2015-01-01T00:00",
 			}},
 		}})
-		sig := macaroons[1].Signature()
-		// example 2 from libmacaroons README
-		c.Check(fmt.Sprintf("%x", sig), gc.Equals, "2eb01d0dd2b4475330739140188648cf25dda0425ea9f661f1574ca0a9eac54e")
-		return sig, nil
-	}, exclude{
-		mcompat.ImplLibMacaroons2: `cannot fake random nonce generator`,
+		defer mcompat.FreeAll(macaroons)
+		return macaroons[1].Signature(), nil
 	})
+	checkErrors(c, errs)
 }
 
-type conditionTest struct {
-	conditions    map[string]bool
-	expectFailure exclude
-	expectErr     string
+func (*suite) TestVerify(c *gc.C) {
+	for i, test := range testCorpus.Verify {
+		if !testVectors.MatchString(test.About) {
+			continue
+		}
+		c.Logf("\ntest %d: %s", i, test.About)
+		checkErrors(c, testRunner.RunVerify(test))
+	}
 }
 
-var verifyTests = []struct {
-	about      string
-	macaroons  []macaroonSpec
-	conditions []conditionTest
-}{{
-	about: "single third party caveat without discharge",
-	macaroons: []macaroonSpec{{
-		rootKey: "root-key",
-		id:      "root-id",
-		caveats: []caveat{{
-			condition: "wonderful",
-		}, {
-			condition: "bob-is-great",
-			location:  "bob",
-			rootKey:   "bob-caveat-root-key",
-		}},
-	}},
-	conditions: []conditionTest{{
-		conditions: map[string]bool{
-			"wonderful": true,
-		},
-		expectErr: `cannot find discharge macaroon for caveat "bob-is-great"`,
-	}},
-}, {
-	about: "single third party caveat with discharge",
-	macaroons: []macaroonSpec{{
-		rootKey: "root-key",
-		id:      "root-id",
-		caveats: []caveat{{
-			condition: "wonderful",
-		}, {
-			condition: "bob-is-great",
-			location:  "bob",
-			rootKey:   "bob-caveat-root-key",
-		}},
-	}, {
-		location: "bob",
-		rootKey:  "bob-caveat-root-key",
-		id:       "bob-is-great",
-	}},
-	conditions: []conditionTest{{
-		conditions: map[string]bool{
-			"wonderful": true,
-		},
-	}, {
-		conditions: map[string]bool{
-			"wonderful": false,
-		},
-		expectErr: `condition "wonderful" not met`,
-	}},
-}, {
-	about: "single third party caveat with discharge with mismatching root key",
-	macaroons: []macaroonSpec{{
-		rootKey: "root-key",
-		id:      "root-id",
-		caveats: []caveat{{
-			condition: "wonderful",
-		}, {
-			condition: "bob-is-great",
-			location:  "bob",
-			rootKey:   "bob-caveat-root-key",
-		}},
-	}, {
-		location: "bob",
-		rootKey:  "bob-caveat-root-key-wrong",
-		id:       "bob-is-great",
-	}},
-	conditions: []conditionTest{{
-		conditions: map[string]bool{
-			"wonderful": true,
-		},
-		expectErr: `signature mismatch after caveat verification`,
-	}},
-}, {
-	about: "single third party caveat with two discharges",
-	macaroons: []macaroonSpec{{
-		rootKey: "root-key",
-		id:      "root-id",
-		caveats: []caveat{{
-			condition: "wonderful",
-		}, {
-			condition: "bob-is-great",
-			location:  "bob",
-			rootKey:   "bob-caveat-root-key",
-		}},
-	}, {
-		location: "bob",
-		rootKey:  "bob-caveat-root-key",
-		id:       "bob-is-great",
-		caveats: []caveat{{
-			condition: "splendid",
-		}},
-	}, {
-		location: "bob",
-		rootKey:  "bob-caveat-root-key",
-		id:       "bob-is-great",
-		caveats: []caveat{{
-			condition: "top of the world",
-		}},
-	}},
-	conditions: []conditionTest{{
-		conditions: map[string]bool{
-			"wonderful": true,
-		},
-		expectErr: `condition "splendid" not met`,
-	}, {
-		conditions: map[string]bool{
-			"wonderful":        true,
-			"splendid":         true,
-			"top of the world": true,
-		},
-		expectFailure: exclude{
-			mcompat.ImplLibMacaroons2: `does not check unused`,
-			mcompat.ImplPyMacaroons2:  `does not check unused`,
-			mcompat.ImplPyMacaroons3:  `does not check unused`,
-		},
-		expectErr: `discharge macaroon "bob-is-great" was not used`,
-	}, {
-		conditions: map[string]bool{
-			"wonderful":        true,
-			"splendid":         false,
-			"top of the world": true,
-		},
-		expectFailure: exclude{
-			mcompat.ImplLibMacaroons2: `doesn't check all the discharge macaroons (arguably correctly)`,
-		},
-		expectErr: `condition "splendid" not met`,
-	}, {
-		conditions: map[string]bool{
-			"wonderful":        true,
-			"splendid":         true,
-			"top of the world": false,
-		},
-		expectFailure: exclude{
-			mcompat.ImplPyMacaroons2: `doesn't check all the discharge macaroons (arguably correctly)`,
-			mcompat.ImplPyMacaroons3: `doesn't check all the discharge macaroons (arguably correctly)`,
-		},
-		expectErr: `discharge macaroon "bob-is-great" was not used`,
-	}},
-}, {
-	about: "one discharge used for two macaroons",
-	macaroons: []macaroonSpec{{
-		rootKey: "root-key",
-		id:      "root-id",
-		caveats: []caveat{{
-			condition: "somewhere else",
-			location:  "bob",
-			rootKey:   "bob-caveat-root-key",
-		}, {
-			condition: "bob-is-great",
-			location:  "charlie",
-			rootKey:   "bob-caveat-root-key",
-		}},
-	}, {
-		location: "bob",
-		rootKey:  "bob-caveat-root-key",
-		id:       "somewhere else",
-		caveats: []caveat{{
-			condition: "bob-is-great",
-			location:  "charlie",
-			rootKey:   "bob-caveat-root-key",
-		}},
-	}, {
-		location: "bob",
-		rootKey:  "bob-caveat-root-key",
-		id:       "bob-is-great",
-	}},
-	conditions: []conditionTest{{
-		expectFailure: exclude{
-			mcompat.ImplLibMacaroons2: `doesn't check multiple use`,
-			mcompat.ImplPyMacaroons2:  `doesn't check multiple use`,
-			mcompat.ImplPyMacaroons3:  `doesn't check multiple use`,
-		},
-		expectErr: `discharge macaroon "bob-is-great" was used more than once`,
-	}},
-}, {
-	about: "recursive third party caveat",
-	macaroons: []macaroonSpec{{
-		rootKey: "root-key",
-		id:      "root-id",
-		caveats: []caveat{{
-			condition: "bob-is-great",
-			location:  "bob",
-			rootKey:   "bob-caveat-root-key",
-		}},
-	}, {
-		location: "bob",
-		rootKey:  "bob-caveat-root-key",
-		id:       "bob-is-great",
-		caveats: []caveat{{
-			condition: "bob-is-great",
-			location:  "charlie",
-			rootKey:   "bob-caveat-root-key",
-		}},
-	}},
-	conditions: []conditionTest{{
-		expectErr: `discharge macaroon "bob-is-great" was used more than once`,
-	}},
-}, {
-	about: "two third party caveats",
-	macaroons: []macaroonSpec{{
-		rootKey: "root-key",
-		id:      "root-id",
-		caveats: []caveat{{
-			condition: "wonderful",
-		}, {
-			condition: "bob-is-great",
-			location:  "bob",
-			rootKey:   "bob-caveat-root-key",
-		}, {
-			condition: "charlie-is-great",
-			location:  "charlie",
-			rootKey:   "charlie-caveat-root-key",
-		}},
-	}, {
-		location: "bob",
-		rootKey:  "bob-caveat-root-key",
-		id:       "bob-is-great",
-		caveats: []caveat{{
-			condition: "splendid",
-		}},
-	}, {
-		location: "charlie",
-		rootKey:  "charlie-caveat-root-key",
-		id:       "charlie-is-great",
-		caveats: []caveat{{
-			condition: "top of the world",
-		}},
-	}},
-	conditions: []conditionTest{{
-		conditions: map[string]bool{
-			"wonderful":        true,
-			"splendid":         true,
-			"top of the world": true,
-		},
-	}, {
-		conditions: map[string]bool{
-			"wonderful":        true,
-			"splendid":         false,
-			"top of the world": true,
-		},
-		expectErr: `condition "splendid" not met`,
-	}, {
-		conditions: map[string]bool{
-			"wonderful":        true,
-			"splendid":         true,
-			"top of the world": false,
-		},
-		expectErr: `condition "top of the world" not met`,
-	}},
-}, {
-	about: "third party caveat with undischarged third party caveat",
-	macaroons: []macaroonSpec{{
-		rootKey: "root-key",
-		id:      "root-id",
-		caveats: []caveat{{
-			condition: "wonderful",
-		}, {
-			condition: "bob-is-great",
-			location:  "bob",
-			rootKey:   "bob-caveat-root-key",
-		}},
-	}, {
-		location: "bob",
-		rootKey:  "bob-caveat-root-key",
-		id:       "bob-is-great",
-		caveats: []caveat{{
-			condition: "splendid",
-		}, {
-			condition: "barbara-is-great",
-			location:  "barbara",
-			rootKey:   "barbara-caveat-root-key",
-		}},
-	}},
-	conditions: []conditionTest{{
-		conditions: map[string]bool{
-			"wonderful": true,
-			"splendid":  true,
-		},
-		expectErr: `cannot find discharge macaroon for caveat "barbara-is-great"`,
-	}},
-}, {
-	about:     "recursive third party caveats",
-	macaroons: recursiveThirdPartyCaveatMacaroons,
-	conditions: []conditionTest{{
-		conditions: map[string]bool{
-			"wonderful":   true,
-			"splendid":    true,
-			"high-fiving": true,
-			"spiffing":    true,
-		},
-	}, {
-		conditions: map[string]bool{
-			"wonderful":   true,
-			"splendid":    true,
-			"high-fiving": false,
-			"spiffing":    true,
-		},
-		expectErr: `condition "high-fiving" not met`,
-	}},
-}, {
-	about: "unused discharge",
-	macaroons: []macaroonSpec{{
-		rootKey: "root-key",
-		id:      "root-id",
-	}, {
-		rootKey: "other-key",
-		id:      "unused",
-	}},
-	conditions: []conditionTest{{
-		expectFailure: exclude{
-			mcompat.ImplLibMacaroons2: `doesn't check unused`,
-			mcompat.ImplPyMacaroons2:  `doesn't check unused`,
-			mcompat.ImplPyMacaroons3:  `doesn't check unused`,
-		},
-		expectErr: `discharge macaroon "unused" was not used`,
-	}},
-}}
-
-var recursiveThirdPartyCaveatMacaroons = []macaroonSpec{{
-	rootKey: "root-key",
-	id:      "root-id",
-	caveats: []caveat{{
-		condition: "wonderful",
-	}, {
-		condition: "bob-is-great",
-		location:  "bob",
-		rootKey:   "bob-caveat-root-key",
-	}, {
-		condition: "charlie-is-great",
-		location:  "charlie",
-		rootKey:   "charlie-caveat-root-key",
-	}},
-}, {
-	location: "bob",
-	rootKey:  "bob-caveat-root-key",
-	id:       "bob-is-great",
-	caveats: []caveat{{
-		condition: "splendid",
-	}, {
-		condition: "barbara-is-great",
-		location:  "barbara",
-		rootKey:   "barbara-caveat-root-key",
-	}},
-}, {
-	location: "charlie",
-	rootKey:  "charlie-caveat-root-key",
-	id:       "charlie-is-great",
-	caveats: []caveat{{
-		condition: "splendid",
-	}, {
-		condition: "celine-is-great",
-		location:  "celine",
-		rootKey:   "celine-caveat-root-key",
-	}},
-}, {
-	location: "barbara",
-	rootKey:  "barbara-caveat-root-key",
-	id:       "barbara-is-great",
-	caveats: []caveat{{
-		condition: "spiffing",
-	}, {
-		condition: "ben-is-great",
-		location:  "ben",
-		rootKey:   "ben-caveat-root-key",
-	}},
-}, {
-	location: "ben",
-	rootKey:  "ben-caveat-root-key",
-	id:       "ben-is-great",
-}, {
-	location: "celine",
-	rootKey:  "celine-caveat-root-key",
-	id:       "celine-is-great",
-	caveats: []caveat{{
-		condition: "high-fiving",
-	}},
-}}
+func (*suite) TestProperties(c *gc.C) {
+	var vectors []mcompat.VerifyVector
+	for _, v := range testCorpus.Verify {
+		if testVectors.MatchString(v.About) {
+			vectors = append(vectors, v)
+		}
+	}
+	// Add some generated vectors too.
+	for i := 0; i < 20; i++ {
+		data := make([]byte, 32)
+		for j := range data {
+			data[j] = byte(i*31 + j*j)
+		}
+		v := mcompat.GenerateVerifyVector(data)
+		v.About = fmt.Sprintf("generated %d", i)
+		vectors = append(vectors, v)
+	}
+	for i, v := range vectors {
+		c.Logf("\ntest %d: %s", i, v.About)
+		checkErrors(c, testRunner.RunProperties(v))
+	}
+}
 
-func (*suite) TestVerify(c *gc.C) {
-	for i, test := range verifyTests {
-		for _, impl := range mcompat.Implementations {
-			c.Logf("\nimplementation %s", impl.Name)
-			rootKey, macaroons := makeMacaroons(impl.Pkg, test.macaroons)
-			for _, cond := range test.conditions {
-				c.Logf("\n-- test %d: %s; %s; %#v", i, test.about, impl.Name, cond.conditions)
-				err := macaroons[0].Verify(
-					rootKey,
-					cond.conditions,
-					macaroons[1:],
-				)
-				if cond.expectFailure.excluded(impl.Name) {
-					if cond.expectErr != "" {
-						c.Check(err, gc.IsNil, gc.Commentf("unexpected failure (usual error: %v)", cond.expectErr))
-					} else {
-						c.Check(err, gc.NotNil, gc.Commentf("unexpected success"))
-					}
-				} else {
-					if cond.expectErr != "" {
-						c.Check(err, gc.NotNil, gc.Commentf("expected error %q", cond.expectErr))
-					} else {
-						c.Check(err, gc.IsNil)
-					}
-				}
-			}
+func (*suite) TestTamper(c *gc.C) {
+	for i, v := range testCorpus.Verify {
+		if !testVectors.MatchString(v.About) {
+			continue
 		}
+		c.Logf("\ntest %d: %s", i, v.About)
+		checkErrors(c, testRunner.RunTamper(v))
 	}
 }
 
-type serializationTest struct {
-	about    string
-	macaroon macaroonSpec
+func (*suite) TestConditions(c *gc.C) {
+	for i, v := range testCorpus.Verify {
+		if !testVectors.MatchString(v.About) {
+			continue
+		}
+		c.Logf("\ntest %d: %s", i, v.About)
+		checkErrors(c, testRunner.RunConditions(v))
+	}
 }
 
-var serializationTests = []serializationTest{{
-	about: "vanilla macaroon",
-	macaroon: macaroonSpec{
-		rootKey: "root-key",
-		id:      "root-id",
-		caveats: []caveat{{
-			condition: "wonderful",
-		}, {
-			condition: "bob-is-great",
-			location:  "bob",
-			rootKey:   "bob-caveat-root-key",
-		}},
-	},
-}, {
-	about: "macaroon with non-ascii text",
-	macaroon: macaroonSpec{
-		rootKey:  "root-key-♔",
-		id:       "root-γ-♔",
-		location: "Москва",
-		caveats: []caveat{{
-			condition: "π > 3",
-		}, {
-			condition: "∃χ: ∀ι∈χ: ι≠∅",
-			location:  "Αθήνα",
-			rootKey:   "root-key-ζ",
-		}},
-	},
-}}
+func (*suite) TestTrace(c *gc.C) {
+	for i, v := range testCorpus.Verify {
+		if !testVectors.MatchString(v.About) {
+			continue
+		}
+		c.Logf("\ntest %d: %s", i, v.About)
+		checkErrors(c, testRunner.RunTrace(v))
+	}
+}
+
+func (*suite) TestVerificationIds(c *gc.C) {
+	for i, v := range testCorpus.Verify {
+		if !testVectors.MatchString(v.About) {
+			continue
+		}
+		c.Logf("\ntest %d: %s", i, v.About)
+		checkErrors(c, testRunner.RunVerificationIds(v))
+	}
+}
+
+func (*suite) TestDischargeAll(c *gc.C) {
+	for i, v := range testCorpus.Verify {
+		if !testVectors.MatchString(v.About) {
+			continue
+		}
+		c.Logf("\ntest %d: %s", i, v.About)
+		checkErrors(c, testRunner.RunDischargeAll(v))
+	}
+}
+
+func (*suite) TestSlice(c *gc.C) {
+	for i, v := range testCorpus.Verify {
+		if !testVectors.MatchString(v.About) {
+			continue
+		}
+		c.Logf("\ntest %d: %s", i, v.About)
+		for _, format := range []mcompat.Format{mcompat.FormatJSON, mcompat.FormatBinary} {
+			checkErrors(c, testRunner.RunSlice(v, format))
+		}
+	}
+}
+
+func (*suite) TestStress(c *gc.C) {
+	if !*stressFlag {
+		c.Skip("stress tests not enabled (use -stress)")
+	}
+	if *replaySessions != "" {
+		c.Skip("cannot measure resources when replaying sessions")
+	}
+	for i, sc := range mcompat.StressCases() {
+		c.Logf("\ntest %d: %s", i, sc.Name)
+		checkErrors(c, testRunner.RunStress(sc, mcompat.DefaultStressBudget))
+	}
+}
 
 func (*suite) TestSerialization(c *gc.C) {
-	tests := serializationTests
-	// Add all the macaroons from verifyTests just to make sure.
-	for i, vtest := range verifyTests {
-		for j, m := range vtest.macaroons {
-			tests = append(tests, serializationTest{
-				about:    fmt.Sprintf("verify test %d.%d: %s", i, j, vtest.about),
-				macaroon: m,
+	tests := append([]mcompat.SerializationVector(nil), testCorpus.Serialization...)
+	// Add all the macaroons from the verify tests just to make sure.
+	for i, vtest := range testCorpus.Verify {
+		for j, m := range vtest.Macaroons {
+			tests = append(tests, mcompat.SerializationVector{
+				About:    fmt.Sprintf("verify test %d.%d: %s", i, j, vtest.About),
+				Macaroon: m,
 			})
 		}
 	}
-	for i, test := range serializationTests {
-		c.Logf("\ntest %d: %s", i, test.about)
-		for _, impl := range mcompat.Implementations {
-			if impl.Name == mcompat.ImplLibMacaroons2 {
-				// Note that libmacaroons doesn't currently support the V1 JSON format.
-				// See https://github.com/rescrv/libmacaroons/issues/49
-				continue
-			}
-			c.Logf("check %s", impl.Name)
-			pkg := impl.Pkg
-			m := makeMacaroon(pkg, test.macaroon)
-			data, err := m.MarshalJSON()
-			c.Assert(err, gc.IsNil)
-			c.Logf("macaroon data:\n%s", data)
-			c.Logf("---- unmarshal checks {")
-			// Check the marshaled form can be unmarshaled by all the other packages.
-			// and that it can be marshaled back and eventually produces the
-			// same representation for all packages.
-			checkConsistency(c, func(pkg mcompat.Package) (interface{}, error) {
-				m, err := pkg.UnmarshalJSON(data)
-				c.Assert(err, gc.IsNil, gc.Commentf("data: %s", data))
-				data, err := m.MarshalJSON()
-				c.Assert(err, gc.IsNil)
-
-				var gom *macaroon.Macaroon
-				err = json.Unmarshal(data, &gom)
-				c.Assert(err, gc.IsNil)
-				data, err = gom.MarshalJSON()
-				c.Assert(err, gc.IsNil)
-				return string(data), nil
-			}, exclude{
-				mcompat.ImplLibMacaroons2: `libmacaroons doesn't currently support the V1 JSON format.`,
-			})
-			c.Logf("}")
+	for i, test := range tests {
+		if !testVectors.MatchString(test.About) {
+			continue
 		}
+		c.Logf("\ntest %d: %s", i, test.About)
+		checkErrors(c, testRunner.RunSerialization(test))
 	}
 }
 
@@ -685,100 +321,21 @@ func macStr(m mcompat.Macaroon) string {
 	return string(data)
 }
 
-func checkConsistency(c *gc.C, f func(mcompat.Package) (interface{}, error), excludeImpls exclude) {
-	impls := mcompat.Implementations
-	gotVal := false
-	var firstVal interface{}
-	var firstErr error
-	for i, impl := range impls {
-		if excludeImpls.excluded(impl.Name) {
-			continue
-		}
-		c.Logf("consistency check %d: %s", i, impl.Name)
-		val, err := f(impl.Pkg)
-		if !gotVal {
-			firstVal, firstErr, gotVal = val, err, true
-			continue
-		}
-		if firstErr != nil {
-			if err != nil {
-				continue
-			}
-			c.Errorf("%s succeeded without expected error %s; value %#v", impls[i].Name, firstErr, val)
-			continue
-		}
-		if err != nil {
-			c.Errorf("%s failed unexpectedly with error %#v", impls[i].Name, err)
-		} else {
-			c.Check(val, jc.DeepEquals, firstVal, gc.Commentf("%s is inconsistent with %s", impls[i].Name, impls[0].Name))
-		}
+// checkErrors reports an error for each of the given
+// errors returned by the test runner.
+func checkErrors(c *gc.C, errs []error) {
+	for _, err := range errs {
+		c.Error(err)
 	}
 }
 
-type caveat struct {
-	rootKey   string
-	location  string
-	condition string
-}
-
-type macaroonSpec struct {
-	rootKey  string
-	id       string
-	caveats  []caveat
-	location string
-}
-
-func makeMacaroons(pkg mcompat.Package, mspecs []macaroonSpec) (
+func makeMacaroons(pkg mcompat.Package, mspecs []mcompat.MacaroonSpec) (
 	rootKey []byte,
 	macaroons []mcompat.Macaroon,
 ) {
-	for _, mspec := range mspecs {
-		macaroons = append(macaroons, makeMacaroon(pkg, mspec))
-	}
-	primary := macaroons[0]
-	discharges := macaroons[1:]
-	for i := range discharges {
-		var err error
-		discharges[i], err = discharges[i].Bind(primary)
-		if err != nil {
-			panic(err)
-		}
-	}
-	return []byte(mspecs[0].rootKey), macaroons
-}
-
-func makeMacaroon(pkg mcompat.Package, mspec macaroonSpec) mcompat.Macaroon {
-	m, err := pkg.New([]byte(mspec.rootKey), mspec.id, mspec.location)
+	rootKey, macaroons, err := mcompat.MakeMacaroons(pkg, mspecs)
 	if err != nil {
 		panic(err)
 	}
-	for _, cav := range mspec.caveats {
-		if cav.location != "" {
-			m, err = m.WithThirdPartyCaveat([]byte(cav.rootKey), cav.condition, cav.location)
-		} else {
-			m, err = m.WithFirstPartyCaveat(cav.condition)
-		}
-		if err != nil {
-			panic(err)
-		}
-	}
-	return m
-}
-
-// exclude specifies a set of implementations to exclude,
-// with associated reasons for the exclusion.
-type exclude map[mcompat.Implementation]string
-
-func (e exclude) excluded(impl mcompat.Implementation) bool {
-	_, ok := e[impl]
-	return ok
-}
-
-type zeroReader struct{}
-
-func (r zeroReader) Read(buf []byte) (int, error) {
-	for i := range buf {
-		buf[i] = 0
-	}
-	return len(buf), nil
+	return rootKey, macaroons
 }
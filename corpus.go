@@ -0,0 +1,456 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// CorpusVersion holds the latest version of the corpus format
+// understood by LoadCorpus. Each version since MinCorpusVersion
+// only adds optional fields to the previous one, so corpus files
+// with any version from MinCorpusVersion up to and including this
+// one can be read.
+const CorpusVersion = 4
+
+// MinCorpusVersion holds the earliest version of the corpus format
+// understood by LoadCorpus. Version 1 recorded divergences as a map
+// from implementation to reason rather than as a list of behaviours,
+// and cannot be converted automatically.
+const MinCorpusVersion = 2
+
+// Corpus holds a set of test vectors that can be
+// run against all the implementations.
+type Corpus struct {
+	// Version holds the version of the corpus format.
+	Version int `json:"version"`
+
+	// Signature holds tests that check that all implementations
+	// produce the same signature for a macaroon.
+	Signature []SignatureVector `json:"signature,omitempty"`
+
+	// Verify holds tests that check that all implementations
+	// verify a set of macaroons in the same way.
+	Verify []VerifyVector `json:"verify,omitempty"`
+
+	// Serialization holds tests that check that macaroons
+	// serialized by one implementation can be deserialized
+	// by all the others.
+	Serialization []SerializationVector `json:"serialization,omitempty"`
+}
+
+// MacaroonSpec specifies a macaroon to be created.
+type MacaroonSpec struct {
+	RootKey  string       `json:"rootKey"`
+	Id       string       `json:"id"`
+	Location string       `json:"location,omitempty"`
+	Caveats  []CaveatSpec `json:"caveats,omitempty"`
+
+	// Bind specifies how a discharge macaroon is bound
+	// by MakeMacaroons. It is ignored for primary macaroons.
+	Bind BindMode `json:"bind,omitempty"`
+
+	// BindTo specifies the macaroon that the discharge
+	// is bound to when Bind is BindOther.
+	BindTo *MacaroonSpec `json:"bindTo,omitempty"`
+
+	// IdFormat specifies the format of the id of a discharge
+	// macaroon. If it is not CaveatIdPlain, Id holds the
+	// condition of the third party caveat that it discharges
+	// and the actual id is encoded from that and RootKey,
+	// as for CaveatSpec.IdFormat.
+	IdFormat CaveatIdFormat `json:"idFormat,omitempty"`
+}
+
+// BindMode specifies how a discharge macaroon is bound.
+type BindMode string
+
+const (
+	// BindPrimary binds the discharge to the primary macaroon.
+	// This is the default.
+	BindPrimary BindMode = ""
+
+	// BindNone leaves the discharge unbound.
+	BindNone BindMode = "none"
+
+	// BindOther binds the discharge to the macaroon
+	// specified by BindTo instead of the primary.
+	BindOther BindMode = "other"
+
+	// BindTwice binds the discharge to the primary macaroon,
+	// then binds the result to the primary macaroon again.
+	BindTwice BindMode = "twice"
+)
+
+// CaveatSpec specifies a caveat to be added to a macaroon.
+// If Location is non-empty, the caveat is a third party
+// caveat with the given caveat root key; otherwise
+// it is a first party caveat.
+type CaveatSpec struct {
+	Condition string `json:"condition"`
+	Location  string `json:"location,omitempty"`
+	RootKey   string `json:"rootKey,omitempty"`
+
+	// IdFormat specifies the format of the id of a third
+	// party caveat, which is encoded from Condition and
+	// RootKey by EncodeCaveatId.
+	IdFormat CaveatIdFormat `json:"idFormat,omitempty"`
+
+	// VerificationId holds the verification id of a third
+	// party caveat. If it is set, the caveat is added with
+	// the reference implementation rather than by encrypting
+	// RootKey with the implementation's own code.
+	VerificationId []byte `json:"verificationId,omitempty"`
+}
+
+// SignatureVector specifies a macaroon and its expected signature.
+type SignatureVector struct {
+	About    string       `json:"about"`
+	Macaroon MacaroonSpec `json:"macaroon"`
+
+	// ExpectSignature holds the expected signature in hex.
+	// If it is empty, the signatures are only checked
+	// for consistency.
+	ExpectSignature string `json:"expectSignature,omitempty"`
+
+	// Divergences holds the behaviours that cause
+	// an implementation to produce a different signature.
+	// Implementations registered in KnownDivergences as
+	// exhibiting any of them are expected to differ.
+	Divergences []Behaviour `json:"divergences,omitempty"`
+}
+
+// VerifyVector specifies a set of macaroons and the expected
+// results of verifying them with different checkers. The first
+// macaroon is the primary; the rest are discharges, which
+// will be bound to the primary.
+type VerifyVector struct {
+	About     string         `json:"about"`
+	Macaroons []MacaroonSpec `json:"macaroons"`
+	Checks    []VerifyCheck  `json:"checks"`
+}
+
+// VerifyCheck specifies the expected result of verifying
+// a set of macaroons with a particular checker.
+type VerifyCheck struct {
+	// Conditions holds the first party conditions that
+	// are satisfied exactly.
+	Conditions Conditions `json:"conditions,omitempty"`
+
+	// Predicates holds any predicates that satisfy
+	// further conditions.
+	Predicates Predicates `json:"predicates,omitempty"`
+
+	// ExpectError holds the error expected from the
+	// reference implementation, or is empty if
+	// verification is expected to succeed.
+	ExpectError string `json:"expectError,omitempty"`
+
+	// ExpectErrorCategory holds the category of the error
+	// in ExpectError.
+	ExpectErrorCategory ErrorCategory `json:"expectErrorCategory,omitempty"`
+
+	// Divergences holds the behaviours that cause an
+	// implementation to produce the opposite result.
+	// Implementations registered in KnownDivergences as
+	// exhibiting any of them are expected to do so.
+	Divergences []Behaviour `json:"divergences,omitempty"`
+}
+
+// Checker returns the checker that satisfies the conditions
+// and predicates in the check.
+func (c VerifyCheck) Checker() Checker {
+	if len(c.Predicates) == 0 {
+		return c.Conditions
+	}
+	return append(Predicates(c.Conditions.Predicates()), c.Predicates...)
+}
+
+// SuccessChecker returns the checker from the first check in the
+// vector that all implementations are expected to verify
+// successfully. It reports false if there is no such check, in
+// which case tests that need a verifying checker ignore the vector.
+func (v VerifyVector) SuccessChecker() (Checker, bool) {
+	for _, check := range v.Checks {
+		if check.ExpectError == "" && len(check.Divergences) == 0 {
+			return check.Checker(), true
+		}
+	}
+	return nil, false
+}
+
+// SerializationVector specifies a macaroon to be serialized.
+type SerializationVector struct {
+	About    string       `json:"about"`
+	Macaroon MacaroonSpec `json:"macaroon"`
+}
+
+// ErrorCategory classifies the reason for a verification failure
+// independently of the error messages produced by the different
+// implementations.
+type ErrorCategory string
+
+const (
+	ErrConditionNotMet    ErrorCategory = "condition-not-met"
+	ErrDischargeNotFound  ErrorCategory = "discharge-not-found"
+	ErrDischargeNotBound  ErrorCategory = "discharge-not-bound"
+	ErrDischargeNotUsed   ErrorCategory = "discharge-not-used"
+	ErrDischargeUsedTwice ErrorCategory = "discharge-used-twice"
+	ErrSignatureMismatch  ErrorCategory = "signature-mismatch"
+)
+
+// LoadCorpus reads all the files with a .json extension in
+// the given directory, in lexical order, and returns
+// the test vectors from all of them combined.
+func LoadCorpus(dir string) (*Corpus, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no corpus files found in %q", dir)
+	}
+	sort.Strings(paths)
+	corpus := &Corpus{
+		Version: CorpusVersion,
+	}
+	for _, path := range paths {
+		c, err := ReadCorpusFile(path)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		corpus.Signature = append(corpus.Signature, c.Signature...)
+		corpus.Verify = append(corpus.Verify, c.Verify...)
+		corpus.Serialization = append(corpus.Serialization, c.Serialization...)
+	}
+	return corpus, nil
+}
+
+// ReadCorpusFile reads a single corpus file.
+func ReadCorpusFile(path string) (*Corpus, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// Check the version first, as the layout of
+	// other versions may differ.
+	var cv struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &cv); err != nil {
+		return nil, errgo.Notef(err, "cannot parse corpus file %q", path)
+	}
+	if cv.Version < MinCorpusVersion || cv.Version > CorpusVersion {
+		return nil, fmt.Errorf("corpus file %q has unsupported version %d (want %d to %d)", path, cv.Version, MinCorpusVersion, CorpusVersion)
+	}
+	var c Corpus
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errgo.Notef(err, "cannot parse corpus file %q", path)
+	}
+	if err := c.validate(); err != nil {
+		return nil, errgo.Notef(err, "invalid corpus file %q", path)
+	}
+	return &c, nil
+}
+
+// validate checks that c holds no vectors that cannot be run.
+func (c *Corpus) validate() error {
+	for i, v := range c.Verify {
+		if len(v.Macaroons) == 0 {
+			return fmt.Errorf("verify vector %d (%q) has no macaroons", i, v.About)
+		}
+	}
+	return nil
+}
+
+// WriteCorpus writes c to w in the format read by ReadCorpusFile.
+// If c.Version is zero, CorpusVersion is written.
+func WriteCorpus(w io.Writer, c *Corpus) error {
+	c1 := *c
+	if c1.Version == 0 {
+		c1.Version = CorpusVersion
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	return enc.Encode(&c1)
+}
+
+// Macaroons returns the specifications of all the
+// macaroons in the corpus.
+func (c *Corpus) Macaroons() []MacaroonSpec {
+	var mspecs []MacaroonSpec
+	for _, v := range c.Signature {
+		mspecs = append(mspecs, v.Macaroon)
+	}
+	for _, v := range c.Verify {
+		mspecs = append(mspecs, v.Macaroons...)
+	}
+	for _, v := range c.Serialization {
+		mspecs = append(mspecs, v.Macaroon)
+	}
+	return mspecs
+}
+
+// MakeMacaroon creates the macaroon specified by mspec using
+// the given implementation. Macaroons with ids that are not valid
+// UTF-8 or with externally supplied verification ids are created
+// by the reference implementation and unmarshaled from the version
+// 2 JSON format by the given implementation.
+func MakeMacaroon(pkg Package, mspec MacaroonSpec) (Macaroon, error) {
+	mspec, err := resolveIds(mspec)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if needsRef(mspec) {
+		m, err := makeRefMacaroon(pkg, mspec)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot create macaroon")
+		}
+		return m, nil
+	}
+	if b, ok := pkg.(macaroonBuilder); ok {
+		m, err := b.build(mspec)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot create macaroon")
+		}
+		return m, nil
+	}
+	m, err := pkg.New([]byte(mspec.RootKey), mspec.Id, mspec.Location)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create macaroon")
+	}
+	for _, cav := range mspec.Caveats {
+		prev := m
+		if cav.Location != "" {
+			m, err = m.WithThirdPartyCaveat([]byte(cav.RootKey), cav.Condition, cav.Location)
+		} else {
+			m, err = m.WithFirstPartyCaveat(cav.Condition)
+		}
+		prev.Free()
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot add caveat %q", cav.Condition)
+		}
+	}
+	return m, nil
+}
+
+// resolveIds returns a copy of mspec with the ids of the
+// macaroon and its third party caveats encoded as specified
+// by their IdFormat fields.
+func resolveIds(mspec MacaroonSpec) (MacaroonSpec, error) {
+	if mspec.IdFormat != CaveatIdPlain {
+		id, err := EncodeCaveatId(mspec.IdFormat, []byte(mspec.RootKey), mspec.Id)
+		if err != nil {
+			return MacaroonSpec{}, errgo.Mask(err)
+		}
+		mspec.Id, mspec.IdFormat = string(id), CaveatIdPlain
+	}
+	caveats := make([]CaveatSpec, len(mspec.Caveats))
+	for i, cav := range mspec.Caveats {
+		if cav.IdFormat != CaveatIdPlain {
+			id, err := EncodeCaveatId(cav.IdFormat, []byte(cav.RootKey), cav.Condition)
+			if err != nil {
+				return MacaroonSpec{}, errgo.Mask(err)
+			}
+			cav.Condition, cav.IdFormat = string(id), CaveatIdPlain
+		}
+		caveats[i] = cav
+	}
+	mspec.Caveats = caveats
+	return mspec, nil
+}
+
+// macaroonBuilder is implemented by packages that can create
+// a whole macaroon more efficiently than by adding each caveat
+// in turn, for example by sending a single batch of expressions
+// to an interpreter.
+type macaroonBuilder interface {
+	build(mspec MacaroonSpec) (Macaroon, error)
+}
+
+// MakeMacaroons creates all the macaroons specified by mspecs
+// using the given implementation and binds all but the first
+// (the primary macaroon) to the first, as specified by
+// their Bind fields. It returns the root key of the primary
+// macaroon along with the macaroons. It returns an error
+// if mspecs is empty.
+func MakeMacaroons(pkg Package, mspecs []MacaroonSpec) (rootKey []byte, macaroons []Macaroon, err error) {
+	return makeMacaroons(pkg, mspecs, MakeMacaroon)
+}
+
+// makeMacaroons implements MakeMacaroons, creating each
+// macaroon with makeMacaroon.
+func makeMacaroons(pkg Package, mspecs []MacaroonSpec, makeMacaroon func(Package, MacaroonSpec) (Macaroon, error)) (rootKey []byte, macaroons []Macaroon, err error) {
+	if len(mspecs) == 0 {
+		return nil, nil, errgo.New("no macaroons specified")
+	}
+	for _, mspec := range mspecs {
+		m, err := makeMacaroon(pkg, mspec)
+		if err != nil {
+			FreeAll(macaroons)
+			return nil, nil, errgo.Mask(err)
+		}
+		macaroons = append(macaroons, m)
+	}
+	primary := macaroons[0]
+	discharges := macaroons[1:]
+	for i, d := range discharges {
+		discharges[i], err = bindDischarge(pkg, primary, d, mspecs[i+1])
+		if discharges[i] != d {
+			d.Free()
+		}
+		if err != nil {
+			discharges[i] = nil
+			FreeAll(macaroons)
+			return nil, nil, errgo.Notef(err, "cannot bind discharge macaroon")
+		}
+	}
+	return []byte(mspecs[0].RootKey), macaroons, nil
+}
+
+// bindDischarge binds the discharge macaroon d as specified
+// by mspec.Bind. It may return d itself.
+func bindDischarge(pkg Package, primary, d Macaroon, mspec MacaroonSpec) (Macaroon, error) {
+	switch mspec.Bind {
+	case BindPrimary:
+		return d.Bind(primary)
+	case BindNone:
+		return d, nil
+	case BindOther:
+		if mspec.BindTo == nil {
+			return nil, fmt.Errorf("no macaroon specified to bind %q to", mspec.Id)
+		}
+		other, err := MakeMacaroon(pkg, *mspec.BindTo)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		defer other.Free()
+		return d.Bind(other)
+	case BindTwice:
+		bound, err := d.Bind(primary)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		defer bound.Free()
+		return bound.Bind(primary)
+	}
+	return nil, fmt.Errorf("unknown bind mode %q", mspec.Bind)
+}
+
+// FreeAll frees all the non-nil macaroons in ms.
+func FreeAll(ms []Macaroon) {
+	for _, m := range ms {
+		if m != nil {
+			m.Free()
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	gc "gopkg.in/check.v1"
+
+	mcompat "github.com/go-macaroon/macarooncompat"
+)
+
+type corpusSuite struct{}
+
+var _ = gc.Suite(&corpusSuite{})
+
+func (*corpusSuite) TestReadCorpusFileVersions(c *gc.C) {
+	dir := c.MkDir()
+	for version := 0; version <= mcompat.CorpusVersion+1; version++ {
+		c.Logf("version %d", version)
+		path := filepath.Join(dir, fmt.Sprintf("v%d.json", version))
+		data := fmt.Sprintf(`{"version": %d, "signature": [{"about": "x", "macaroon": {"rootKey": "k", "id": "i"}}]}`, version)
+		err := ioutil.WriteFile(path, []byte(data), 0666)
+		c.Assert(err, gc.IsNil)
+		corpus, err := mcompat.ReadCorpusFile(path)
+		if version < mcompat.MinCorpusVersion || version > mcompat.CorpusVersion {
+			c.Assert(err, gc.ErrorMatches, `corpus file ".*" has unsupported version .*`)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		c.Assert(corpus.Signature, gc.HasLen, 1)
+	}
+}
+
+func (*corpusSuite) TestReadOldCorpusFiles(c *gc.C) {
+	// These files were written by earlier versions
+	// of this package.
+	_, err := mcompat.ReadCorpusFile("testdata/oldcorpus/v1-verify.json")
+	c.Assert(err, gc.ErrorMatches, `corpus file ".*" has unsupported version 1 \(want 2 to [0-9]+\)`)
+
+	corpus, err := mcompat.ReadCorpusFile("testdata/oldcorpus/v2-verify.json")
+	c.Assert(err, gc.IsNil)
+	c.Assert(corpus.Verify, gc.HasLen, 10)
+	var divergences []mcompat.Behaviour
+	for _, v := range corpus.Verify {
+		for _, check := range v.Checks {
+			divergences = append(divergences, check.Divergences...)
+		}
+	}
+	c.Assert(divergences, gc.DeepEquals, []mcompat.Behaviour{
+		mcompat.BehaviourUnusedDischarge,
+		mcompat.BehaviourLastDuplicateDischarge,
+		mcompat.BehaviourFirstDuplicateDischarge,
+		mcompat.BehaviourDischargeReuse,
+		mcompat.BehaviourUnusedDischarge,
+	})
+}
+
+func (*corpusSuite) TestSuccessChecker(c *gc.C) {
+	v := mcompat.VerifyVector{
+		Checks: []mcompat.VerifyCheck{{
+			Conditions:  mcompat.Conditions{"a": true},
+			ExpectError: "condition not met",
+		}, {
+			Conditions:  mcompat.Conditions{"b": true},
+			Divergences: []mcompat.Behaviour{mcompat.BehaviourUnusedDischarge},
+		}, {
+			Conditions: mcompat.Conditions{"c": true},
+		}, {
+			Conditions: mcompat.Conditions{"d": true},
+		}},
+	}
+	checker, ok := v.SuccessChecker()
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(checker, gc.DeepEquals, mcompat.Conditions{"c": true})
+
+	v.Checks = v.Checks[:2]
+	checker, ok = v.SuccessChecker()
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(checker, gc.IsNil)
+}
+
+func (*corpusSuite) TestReadCorpusFileWithEmptyVerifyVector(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "empty.json")
+	data := fmt.Sprintf(`{"version": %d, "verify": [{"about": "no macaroons", "macaroons": [], "checks": [{}]}]}`, mcompat.CorpusVersion)
+	err := ioutil.WriteFile(path, []byte(data), 0666)
+	c.Assert(err, gc.IsNil)
+	_, err = mcompat.ReadCorpusFile(path)
+	c.Assert(err, gc.ErrorMatches, `invalid corpus file ".*": verify vector 0 \("no macaroons"\) has no macaroons`)
+}
+
+func (*corpusSuite) TestMakeMacaroonsWithNoMacaroons(c *gc.C) {
+	impl, ok := testImpl(c, mcompat.ImplGoV2)
+	if !ok {
+		c.Skip("gov2 implementation not selected")
+	}
+	_, macaroons, err := mcompat.MakeMacaroons(impl.Pkg, nil)
+	c.Assert(err, gc.ErrorMatches, `no macaroons specified`)
+	c.Assert(macaroons, gc.IsNil)
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"fmt"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// maxDischargeDepth holds the maximum length of a chain of
+// discharges that DischargeAll will follow.
+const maxDischargeDepth = 1000
+
+// DischargeAll gathers discharge macaroons for all the third party
+// caveats in primary and, recursively, in the discharges themselves,
+// by calling getDischarge for each caveat in breadth-first order. The
+// discharges are bound to primary and returned in the order they were
+// obtained. Only one discharge is obtained for each caveat id, so
+// cyclic chains of discharges terminate, and an error is returned if
+// a chain is longer than maxDischargeDepth.
+//
+// The walk itself is done here rather than by the libraries, most of
+// which have no equivalent. The caveats are read with each
+// macaroon's Caveats method and the discharges are bound with their
+// own Bind method, so what is compared between implementations is
+// the caveats they report and the binding, not their own walkers.
+//
+// The discharges returned by getDischarge must be from the same
+// implementation as primary. DischargeAll frees them when it
+// has finished with them.
+func DischargeAll(primary Macaroon, getDischarge func(cav Caveat) (Macaroon, error)) ([]Macaroon, error) {
+	type pendingCaveat struct {
+		Caveat
+		depth int
+	}
+	var pending []pendingCaveat
+	addCaveats := func(m Macaroon, depth int) error {
+		caveats, err := m.Caveats()
+		if err != nil {
+			return err
+		}
+		for _, cav := range caveats {
+			pending = append(pending, pendingCaveat{cav, depth})
+		}
+		return nil
+	}
+	if err := addCaveats(primary, 1); err != nil {
+		return nil, errgo.Notef(err, "cannot get caveats")
+	}
+	var discharges []Macaroon
+	fail := func(err error) ([]Macaroon, error) {
+		FreeAll(discharges)
+		return nil, err
+	}
+	discharged := make(map[string]bool)
+	for len(pending) > 0 {
+		cav := pending[0]
+		pending = pending[1:]
+		if cav.VerificationId == nil || discharged[string(cav.Id)] {
+			continue
+		}
+		if cav.depth > maxDischargeDepth {
+			return fail(errgo.Newf("discharge chain too deep (more than %d discharges)", maxDischargeDepth))
+		}
+		discharged[string(cav.Id)] = true
+		d, err := getDischarge(cav.Caveat)
+		if err != nil {
+			return fail(errgo.Notef(err, "cannot get discharge from %q", cav.Location))
+		}
+		if err := addCaveats(d, cav.depth+1); err != nil {
+			d.Free()
+			return fail(errgo.Notef(err, "cannot get caveats of discharge from %q", cav.Location))
+		}
+		bound, err := d.Bind(primary)
+		if bound != d {
+			d.Free()
+		}
+		if err != nil {
+			return fail(errgo.Notef(err, "cannot bind discharge from %q", cav.Location))
+		}
+		discharges = append(discharges, bound)
+	}
+	return discharges, nil
+}
+
+// dischargeAllResult holds the result of gathering and
+// verifying discharges with DischargeAll.
+type dischargeAllResult struct {
+	// Ids holds the ids of the discharges in the
+	// order they were obtained.
+	Ids []string
+
+	// Verified holds whether the primary macaroon
+	// verified successfully with the discharges.
+	Verified bool
+}
+
+// RunDischargeAll gathers discharges for the primary macaroon in the
+// given vector with DischargeAll in each implementation, taking each
+// discharge from the first of the vector's other macaroons with the
+// same id, and checks that all implementations obtain the same
+// discharges in the same order and agree on whether the primary
+// verifies with them, using the checker returned by
+// VerifyVector.SuccessChecker.
+func (r *Runner) RunDischargeAll(v VerifyVector) []error {
+	r = r.supporting("discharge all: "+v.About, v.Macaroons...)
+	checker, ok := v.SuccessChecker()
+	if !ok {
+		return nil
+	}
+	r.logf("discharge all test: %s", v.About)
+	_, errs := r.CheckConsistency("discharge all: "+v.About, nil, nil, func(pkg Package) (interface{}, error) {
+		return dischargeAll(pkg, v.Macaroons, checker)
+	})
+	return errs
+}
+
+// dischargeAll creates the primary macaroon in mspecs with the given
+// package, gathers its discharges from the rest of mspecs with
+// DischargeAll and verifies it with them.
+func dischargeAll(pkg Package, mspecs []MacaroonSpec, check Checker) (dischargeAllResult, error) {
+	var dspecs []MacaroonSpec
+	for _, mspec := range mspecs[1:] {
+		mspec, err := resolveIds(mspec)
+		if err != nil {
+			return dischargeAllResult{}, errgo.Mask(err)
+		}
+		dspecs = append(dspecs, mspec)
+	}
+	primary, err := MakeMacaroon(pkg, mspecs[0])
+	if err != nil {
+		return dischargeAllResult{}, errgo.Mask(err)
+	}
+	defer primary.Free()
+	var ids []string
+	discharges, err := DischargeAll(primary, func(cav Caveat) (Macaroon, error) {
+		for _, dspec := range dspecs {
+			if dspec.Id == string(cav.Id) {
+				ids = append(ids, dspec.Id)
+				return MakeMacaroon(pkg, dspec)
+			}
+		}
+		return nil, fmt.Errorf("no discharge found for caveat %q", cav.Id)
+	})
+	if err != nil {
+		return dischargeAllResult{}, errgo.Mask(err)
+	}
+	defer FreeAll(discharges)
+	return dischargeAllResult{
+		Ids:      ids,
+		Verified: primary.Verify([]byte(mspecs[0].RootKey), check, discharges) == nil,
+	}, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat_test
+
+import (
+	"fmt"
+
+	gc "gopkg.in/check.v1"
+
+	mcompat "github.com/go-macaroon/macarooncompat"
+)
+
+type dischargeAllSuite struct{}
+
+var _ = gc.Suite(&dischargeAllSuite{})
+
+func chainCaveat(i int) mcompat.CaveatSpec {
+	return mcompat.CaveatSpec{
+		Condition: fmt.Sprintf("tp %d", i),
+		Location:  "tp",
+		RootKey:   fmt.Sprintf("tp key %d", i),
+	}
+}
+
+func (*dischargeAllSuite) TestDischargeAllCycle(c *gc.C) {
+	impl, ok := testImpl(c, mcompat.ImplGoV2)
+	if !ok {
+		c.Skip("gov2 implementation not selected")
+	}
+	// Two discharges that each require the other.
+	dspecs := map[string]mcompat.MacaroonSpec{
+		"tp 0": {RootKey: "tp key 0", Id: "tp 0", Caveats: []mcompat.CaveatSpec{chainCaveat(1)}},
+		"tp 1": {RootKey: "tp key 1", Id: "tp 1", Caveats: []mcompat.CaveatSpec{chainCaveat(0)}},
+	}
+	primary, err := mcompat.MakeMacaroon(impl.Pkg, mcompat.MacaroonSpec{
+		RootKey: "root-key",
+		Id:      "root-id",
+		Caveats: []mcompat.CaveatSpec{chainCaveat(0)},
+	})
+	c.Assert(err, gc.IsNil)
+	defer primary.Free()
+	var ids []string
+	discharges, err := mcompat.DischargeAll(primary, func(cav mcompat.Caveat) (mcompat.Macaroon, error) {
+		ids = append(ids, string(cav.Id))
+		return mcompat.MakeMacaroon(impl.Pkg, dspecs[string(cav.Id)])
+	})
+	c.Assert(err, gc.IsNil)
+	defer mcompat.FreeAll(discharges)
+	c.Assert(ids, gc.DeepEquals, []string{"tp 0", "tp 1"})
+	c.Assert(discharges, gc.HasLen, 2)
+}
+
+func (*dischargeAllSuite) TestDischargeAllTooDeep(c *gc.C) {
+	impl, ok := testImpl(c, mcompat.ImplGoV2)
+	if !ok {
+		c.Skip("gov2 implementation not selected")
+	}
+	primary, err := mcompat.MakeMacaroon(impl.Pkg, mcompat.MacaroonSpec{
+		RootKey: "root-key",
+		Id:      "root-id",
+		Caveats: []mcompat.CaveatSpec{chainCaveat(0)},
+	})
+	c.Assert(err, gc.IsNil)
+	defer primary.Free()
+	// Each discharge requires a new one, so the chain never ends.
+	n := 0
+	discharges, err := mcompat.DischargeAll(primary, func(cav mcompat.Caveat) (mcompat.Macaroon, error) {
+		n++
+		return mcompat.MakeMacaroon(impl.Pkg, mcompat.MacaroonSpec{
+			RootKey: fmt.Sprintf("tp key %d", n-1),
+			Id:      string(cav.Id),
+			Caveats: []mcompat.CaveatSpec{chainCaveat(n)},
+		})
+	})
+	c.Assert(err, gc.ErrorMatches, `discharge chain too deep \(more than 1000 discharges\)`)
+	c.Assert(discharges, gc.IsNil)
+	c.Assert(n, gc.Equals, 1000)
+}
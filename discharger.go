@@ -0,0 +1,368 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// ErrDischargeRefused is the cause of the error returned when
+// a Discharger refuses to discharge a caveat.
+var ErrDischargeRefused = errgo.New("discharge refused")
+
+// Discharger simulates a third party service that discharges
+// caveats with ids in one of the bakery formats (see
+// EncodeCaveatId). It decodes each caveat id as a real third
+// party would, and mints the discharge macaroon with its Pkg.
+type Discharger struct {
+	// Pkg holds the implementation used to create
+	// discharge macaroons.
+	Pkg Package
+
+	// Location holds the location of the discharge macaroons.
+	Location string
+
+	// Caveats, if non-nil, is called with the condition of
+	// each caveat to be discharged. It returns the conditions
+	// of any first party caveats to add to the discharge
+	// macaroon, or an error if the caveat should not be
+	// discharged.
+	Caveats func(cond string) ([]string, error)
+}
+
+// Discharge returns a discharge macaroon for the third party
+// caveat with the given id. The discharge is not bound to
+// any primary macaroon.
+func (d *Discharger) Discharge(id []byte) (Macaroon, error) {
+	_, rootKey, cond, err := DecodeCaveatId(id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if rootKey == nil {
+		return nil, errgo.Newf("cannot discharge caveat with plain id %q", id)
+	}
+	mspec := MacaroonSpec{
+		RootKey:  string(rootKey),
+		Id:       string(id),
+		Location: d.Location,
+	}
+	if d.Caveats != nil {
+		conds, err := d.Caveats(cond)
+		if err != nil {
+			return nil, errgo.WithCausef(err, ErrDischargeRefused, "cannot discharge %q", cond)
+		}
+		for _, cond := range conds {
+			mspec.Caveats = append(mspec.Caveats, CaveatSpec{
+				Condition: cond,
+			})
+		}
+	}
+	m, err := MakeMacaroon(d.Pkg, mspec)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot make discharge macaroon")
+	}
+	return m, nil
+}
+
+// dischargeResponse holds the body of a successful
+// response from Discharger.ServeHTTP.
+type dischargeResponse struct {
+	Macaroon json.RawMessage
+}
+
+// dischargeError holds the body of an error
+// response from Discharger.ServeHTTP.
+type dischargeError struct {
+	Message string
+}
+
+// ServeHTTP implements http.Handler by discharging the caveat whose
+// id is held, base64 encoded, in the id64 form value. The discharge
+// macaroon is returned in the Macaroon field of a JSON object.
+// Refusals are returned with a 403 (Forbidden) status, and
+// ids that cannot be discharged with a 400 (Bad Request) status.
+func (d *Discharger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeDischargeError(w, http.StatusMethodNotAllowed, errgo.Newf("method %s not allowed", req.Method))
+		return
+	}
+	id, err := decodeBase64(req.FormValue("id64"))
+	if err != nil {
+		writeDischargeError(w, http.StatusBadRequest, errgo.Notef(err, "bad id64"))
+		return
+	}
+	m, err := d.Discharge(id)
+	if err != nil {
+		code := http.StatusBadRequest
+		if errgo.Cause(err) == ErrDischargeRefused {
+			code = http.StatusForbidden
+		}
+		writeDischargeError(w, code, err)
+		return
+	}
+	defer m.Free()
+	data, err := m.MarshalJSON()
+	if err != nil {
+		writeDischargeError(w, http.StatusInternalServerError, errgo.Notef(err, "cannot marshal discharge macaroon"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dischargeResponse{
+		Macaroon: data,
+	})
+}
+
+func writeDischargeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(dischargeError{
+		Message: err.Error(),
+	})
+}
+
+// DischargeHTTP asks the discharger at the given URL, which
+// must be served by Discharger.ServeHTTP, to discharge the
+// caveat with the given id, and unmarshals the discharge
+// macaroon with the given package. If the discharger refuses
+// to discharge the caveat, the returned error has
+// ErrDischargeRefused as its cause.
+func DischargeHTTP(pkg Package, client *http.Client, dischargeURL string, id []byte) (Macaroon, error) {
+	resp, err := client.PostForm(dischargeURL, url.Values{
+		"id64": {base64.RawURLEncoding.EncodeToString(id)},
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errResp dischargeError
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+			return nil, errgo.Newf("discharge failed with status %q", resp.Status)
+		}
+		if resp.StatusCode == http.StatusForbidden {
+			return nil, errgo.WithCausef(nil, ErrDischargeRefused, "discharge failed: %s", errResp.Message)
+		}
+		return nil, errgo.Newf("discharge failed: %s", errResp.Message)
+	}
+	var dresp dischargeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&dresp); err != nil {
+		return nil, errgo.Notef(err, "cannot decode discharge response")
+	}
+	m, err := pkg.UnmarshalJSON(dresp.Macaroon)
+	if err != nil {
+		if m != nil {
+			m.Free()
+		}
+		return nil, errgo.Notef(err, "cannot unmarshal discharge macaroon")
+	}
+	return m, nil
+}
+
+// DischargeFlow describes an end-to-end test in which a client
+// acquires discharges for the third party caveats in a macaroon
+// from a Discharger, binds them and verifies the result.
+type DischargeFlow struct {
+	About string
+
+	// Macaroon holds the primary macaroon. Its third party
+	// caveats should have ids in one of the bakery formats
+	// so that the discharger can decode them.
+	Macaroon MacaroonSpec
+
+	// DischargeCaveats maps the condition of each third party
+	// caveat to the first party conditions the discharger adds
+	// to its discharge macaroon. If a condition is not present,
+	// the discharger refuses to discharge it.
+	DischargeCaveats map[string][]string
+
+	// Check holds the checker used to verify the primary
+	// macaroon with its discharges.
+	Check Checker
+
+	// ExpectError holds a regular expression matching the
+	// whole of the error expected from the flow, or is empty
+	// if the flow is expected to succeed. A refused discharge
+	// produces an error starting "cannot acquire discharge: "
+	// and a failed verification one starting "cannot verify: ".
+	ExpectError string
+}
+
+// RunDischargeFlow runs the given flow with each pair of
+// implementations, one acting as the client that creates, binds and
+// verifies the macaroons and the other as the discharger. If useHTTP
+// is true, the discharges are obtained from the discharger over a
+// loopback HTTP listener; otherwise they are passed to the client
+// in-process in the JSON format. Pairs in which the client cannot
+// read the JSON format written by the discharger are skipped and
+// recorded as divergent.
+func (r *Runner) RunDischargeFlow(f DischargeFlow, useHTTP bool) []error {
+	r = r.supporting("discharge flow: "+f.About, f.Macaroon)
+	r.logf("discharge flow test: %s", f.About)
+	transport := "in-process"
+	if useHTTP {
+		transport = "http"
+	}
+	var errs []error
+	for _, dimpl := range r.Impls {
+		// Implementations that cannot write the version 1
+		// JSON format write version 2 instead.
+		unsupported := []Behaviour{BehaviourNoJSONV1}
+		if _, ok := r.KnownDivergence(dimpl.Name, unsupported); ok {
+			unsupported = []Behaviour{BehaviourNoJSONV2}
+		}
+		d := &Discharger{
+			Pkg:      dimpl.Pkg,
+			Location: "discharger",
+			Caveats: func(cond string) ([]string, error) {
+				conds, ok := f.DischargeCaveats[cond]
+				if !ok {
+					return nil, errgo.Newf("condition %q refused", cond)
+				}
+				return conds, nil
+			},
+		}
+		acquire := func(pkg Package, id []byte) (Macaroon, error) {
+			return transferDischarge(pkg, d, id)
+		}
+		var srv *httptest.Server
+		if useHTTP {
+			srv = httptest.NewServer(d)
+			acquire = func(pkg Package, id []byte) (Macaroon, error) {
+				return DischargeHTTP(pkg, srv.Client(), srv.URL, id)
+			}
+		}
+		for _, impl := range r.Impls {
+			check := fmt.Sprintf("discharge flow: %s (discharged by %s, %s)", f.About, dimpl.Name, transport)
+			if d, ok := r.KnownDivergence(impl.Name, unsupported); ok {
+				r.logf("skipping %s with discharger %s: %s", impl.Name, dimpl.Name, d.Reason)
+				r.add(check, impl.Name, Result{
+					Outcome: OutcomeDivergent,
+					Reason:  d.Reason,
+				})
+				continue
+			}
+			flowErr, err := runDischargeFlow(impl.Pkg, f, acquire)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s %v", check, impl.Name, err))
+				r.add(check, impl.Name, Result{
+					Outcome: OutcomeFail,
+					Reason:  err.Error(),
+				})
+				continue
+			}
+			if reason := checkFlowError(flowErr, f.ExpectError); reason != "" {
+				errs = append(errs, fmt.Errorf("%s: %s %s", check, impl.Name, reason))
+				r.add(check, impl.Name, Result{
+					Outcome: OutcomeFail,
+					Reason:  reason,
+				})
+				continue
+			}
+			r.add(check, impl.Name, Result{Outcome: OutcomePass})
+		}
+		if srv != nil {
+			srv.Close()
+		}
+	}
+	return errs
+}
+
+// checkFlowError checks that flowErr matches the regular expression
+// expectErr, which is empty if no error is expected. It returns the
+// reason for the failure, or the empty string if there is none.
+func checkFlowError(flowErr error, expectErr string) string {
+	switch {
+	case flowErr == nil && expectErr == "":
+		return ""
+	case flowErr == nil:
+		return fmt.Sprintf("unexpected success (expected error %q)", expectErr)
+	case expectErr == "":
+		return fmt.Sprintf("unexpected error: %v", flowErr)
+	}
+	ok, err := regexp.MatchString("^(?:"+expectErr+")$", flowErr.Error())
+	if err != nil {
+		return fmt.Sprintf("bad error pattern %q: %v", expectErr, err)
+	}
+	if !ok {
+		return fmt.Sprintf("error %q does not match %q", flowErr, expectErr)
+	}
+	return ""
+}
+
+// transferDischarge obtains a discharge for the caveat with
+// the given id from d and passes it to the given package
+// in the JSON format.
+func transferDischarge(pkg Package, d *Discharger, id []byte) (Macaroon, error) {
+	dm, err := d.Discharge(id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrDischargeRefused))
+	}
+	defer dm.Free()
+	data, err := dm.MarshalJSON()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot marshal discharge macaroon")
+	}
+	m, err := pkg.UnmarshalJSON(data)
+	if err != nil {
+		if m != nil {
+			m.Free()
+		}
+		return nil, errgo.Notef(err, "cannot unmarshal discharge macaroon")
+	}
+	return m, nil
+}
+
+// runDischargeFlow creates the primary macaroon in f with the given
+// package, acquires and binds a discharge for each of its third party
+// caveats, and verifies the result. Refused discharges and failures
+// to verify are returned as flowErr; any other failure, such as an
+// interpreter crash or an HTTP error, means that the flow cannot be
+// run at all and is returned as err.
+func runDischargeFlow(pkg Package, f DischargeFlow, acquire func(pkg Package, id []byte) (Macaroon, error)) (flowErr, err error) {
+	primary, err := MakeMacaroon(pkg, f.Macaroon)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer primary.Free()
+	caveats, err := primary.Caveats()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get caveats")
+	}
+	var discharges []Macaroon
+	defer func() {
+		FreeAll(discharges)
+	}()
+	for _, cav := range caveats {
+		if cav.VerificationId == nil {
+			continue
+		}
+		d, err := acquire(pkg, cav.Id)
+		if err != nil {
+			if errgo.Cause(err) == ErrDischargeRefused {
+				return errgo.Notef(err, "cannot acquire discharge"), nil
+			}
+			return nil, errgo.Notef(err, "cannot acquire discharge")
+		}
+		bound, err := d.Bind(primary)
+		if bound != d {
+			d.Free()
+		}
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot bind discharge macaroon")
+		}
+		discharges = append(discharges, bound)
+	}
+	if err := primary.Verify([]byte(f.Macaroon.RootKey), f.Check, discharges); err != nil {
+		return errgo.Notef(err, "cannot verify"), nil
+	}
+	return nil, nil
+}
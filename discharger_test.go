@@ -0,0 +1,151 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat_test
+
+import (
+	"net/http/httptest"
+
+	gc "gopkg.in/check.v1"
+	errgo "gopkg.in/errgo.v1"
+
+	mcompat "github.com/go-macaroon/macarooncompat"
+)
+
+var dischargeFlows = []mcompat.DischargeFlow{{
+	About: "bakery-v1 caveat",
+	Macaroon: mcompat.MacaroonSpec{
+		RootKey: "root-key",
+		Id:      "root-id",
+		Caveats: []mcompat.CaveatSpec{{
+			Condition: "wonderful",
+		}, {
+			Condition: "is-authenticated",
+			Location:  "discharger",
+			RootKey:   "caveat-root-key",
+			IdFormat:  mcompat.CaveatIdBakeryV1,
+		}},
+	},
+	DischargeCaveats: map[string][]string{
+		"is-authenticated": {"declared user bob"},
+	},
+	Check: mcompat.Conditions{
+		"wonderful":         true,
+		"declared user bob": true,
+	},
+}, {
+	About: "bakery-v2 and bakery-v3 caveats",
+	Macaroon: mcompat.MacaroonSpec{
+		RootKey: "root-key",
+		Id:      "root-id",
+		Caveats: []mcompat.CaveatSpec{{
+			Condition: "is-authenticated",
+			Location:  "discharger",
+			RootKey:   "caveat-root-key-1",
+			IdFormat:  mcompat.CaveatIdBakeryV2,
+		}, {
+			Condition: "is-member-of admin",
+			Location:  "discharger",
+			RootKey:   "caveat-root-key-2",
+			IdFormat:  mcompat.CaveatIdBakeryV3,
+		}},
+	},
+	DischargeCaveats: map[string][]string{
+		"is-authenticated":   {"declared user bob"},
+		"is-member-of admin": nil,
+	},
+	Check: mcompat.Conditions{
+		"declared user bob": true,
+	},
+}, {
+	About: "discharge caveat not satisfied",
+	Macaroon: mcompat.MacaroonSpec{
+		RootKey: "root-key",
+		Id:      "root-id",
+		Caveats: []mcompat.CaveatSpec{{
+			Condition: "is-authenticated",
+			Location:  "discharger",
+			RootKey:   "caveat-root-key",
+			IdFormat:  mcompat.CaveatIdBakeryV2,
+		}},
+	},
+	DischargeCaveats: map[string][]string{
+		"is-authenticated": {"declared user bob"},
+	},
+	Check: mcompat.Conditions{
+		"declared user alice": true,
+	},
+	ExpectError: `cannot verify: .*`,
+}, {
+	About: "discharge refused",
+	Macaroon: mcompat.MacaroonSpec{
+		RootKey: "root-key",
+		Id:      "root-id",
+		Caveats: []mcompat.CaveatSpec{{
+			Condition: "is-authenticated",
+			Location:  "discharger",
+			RootKey:   "caveat-root-key",
+			IdFormat:  mcompat.CaveatIdBakeryV1,
+		}},
+	},
+	Check:       mcompat.Conditions{},
+	ExpectError: `cannot acquire discharge: .*cannot discharge "is-authenticated": condition "is-authenticated" refused`,
+}}
+
+func (*suite) TestDischargeFlow(c *gc.C) {
+	for i, f := range dischargeFlows {
+		c.Logf("\ntest %d: %s", i, f.About)
+		checkErrors(c, testRunner.RunDischargeFlow(f, false))
+	}
+}
+
+func (*suite) TestDischargeFlowHTTP(c *gc.C) {
+	for i, f := range dischargeFlows {
+		c.Logf("\ntest %d: %s", i, f.About)
+		checkErrors(c, testRunner.RunDischargeFlow(f, true))
+	}
+}
+
+type dischargerSuite struct{}
+
+var _ = gc.Suite(&dischargerSuite{})
+
+func (*dischargerSuite) TestDischargePlainId(c *gc.C) {
+	impl, ok := testImpl(c, mcompat.ImplGoV2)
+	if !ok {
+		c.Skip("gov2 implementation not selected")
+	}
+	d := &mcompat.Discharger{
+		Pkg: impl.Pkg,
+	}
+	m, err := d.Discharge([]byte("is-authenticated"))
+	c.Assert(err, gc.ErrorMatches, `cannot discharge caveat with plain id "is-authenticated"`)
+	c.Assert(m, gc.IsNil)
+}
+
+func (*dischargerSuite) TestDischargeHTTPRefused(c *gc.C) {
+	impl, ok := testImpl(c, mcompat.ImplGoV2)
+	if !ok {
+		c.Skip("gov2 implementation not selected")
+	}
+	d := &mcompat.Discharger{
+		Pkg: impl.Pkg,
+		Caveats: func(cond string) ([]string, error) {
+			return nil, errgo.Newf("condition %q refused", cond)
+		},
+	}
+	srv := httptest.NewServer(d)
+	defer srv.Close()
+	id, err := mcompat.EncodeCaveatId(mcompat.CaveatIdBakeryV2, []byte("caveat-root-key"), "is-authenticated")
+	c.Assert(err, gc.IsNil)
+	m, err := mcompat.DischargeHTTP(impl.Pkg, srv.Client(), srv.URL, id)
+	c.Assert(err, gc.ErrorMatches, `discharge failed: cannot discharge "is-authenticated": condition "is-authenticated" refused`)
+	c.Assert(errgo.Cause(err), gc.Equals, mcompat.ErrDischargeRefused)
+	c.Assert(m, gc.IsNil)
+
+	// A plain id is not a refusal.
+	m, err = mcompat.DischargeHTTP(impl.Pkg, srv.Client(), srv.URL, []byte("is-authenticated"))
+	c.Assert(err, gc.ErrorMatches, `discharge failed: cannot discharge caveat with plain id "is-authenticated"`)
+	c.Assert(errgo.Cause(err), gc.Not(gc.Equals), mcompat.ErrDischargeRefused)
+	c.Assert(m, gc.IsNil)
+}
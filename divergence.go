@@ -0,0 +1,170 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"regexp"
+)
+
+// Behaviour names an aspect of macaroon handling in which
+// some implementations are known to differ from the others.
+type Behaviour string
+
+const (
+	// BehaviourUnusedDischarge is exhibited by implementations
+	// that do not reject discharge macaroons that are not
+	// required by any third party caveat.
+	BehaviourUnusedDischarge Behaviour = "unused-discharge-accepted"
+
+	// BehaviourDischargeReuse is exhibited by implementations
+	// that allow a discharge macaroon to discharge more than
+	// one third party caveat.
+	BehaviourDischargeReuse Behaviour = "discharge-reuse-accepted"
+
+	// BehaviourLastDuplicateDischarge is exhibited by
+	// implementations that, when there are several discharge
+	// macaroons with the same id, check only the last of them.
+	BehaviourLastDuplicateDischarge Behaviour = "duplicate-discharge-last"
+
+	// BehaviourFirstDuplicateDischarge is exhibited by
+	// implementations that, when there are several discharge
+	// macaroons with the same id, check only the first of them.
+	BehaviourFirstDuplicateDischarge Behaviour = "duplicate-discharge-first"
+
+	// BehaviourRandomNonce is exhibited by implementations that
+	// always use a random nonce when adding a third party caveat,
+	// so their signatures cannot be reproduced.
+	BehaviourRandomNonce Behaviour = "random-nonce"
+
+	// BehaviourNoJSONV1 is exhibited by implementations that cannot
+	// serialize macaroons in the version 1 JSON format.
+	BehaviourNoJSONV1 Behaviour = "no-json-v1"
+
+	// BehaviourNoBinary is exhibited by implementations that cannot
+	// serialize or deserialize macaroons in the binary format.
+	BehaviourNoBinary Behaviour = "no-binary"
+
+	// BehaviourNoJSONV2 is exhibited by implementations that cannot
+	// deserialize macaroons in the version 2 JSON format (or the
+	// version 2 binary format), and so
+	// cannot be used with macaroons that have binary ids or
+	// externally supplied verification ids.
+	BehaviourNoJSONV2 Behaviour = "no-json-v2"
+)
+
+// KnownDivergence records that an implementation exhibits
+// a behaviour that differs from the reference implementation.
+type KnownDivergence struct {
+	Impl      Implementation
+	Behaviour Behaviour
+
+	// Versions holds a regular expression that must match
+	// the whole version of the implementation's library
+	// (as returned by Package.LibraryVersion) for the
+	// divergence to apply. If it is empty, all versions
+	// are assumed to diverge.
+	Versions string
+
+	// Reason holds a description of the divergence.
+	Reason string
+}
+
+// KnownDivergences holds all the known divergences between
+// implementations. When a library is changed so that a
+// divergence no longer occurs, the tests will report it
+// as unexpectedly passing, and the entry should be
+// removed or restricted to the older versions.
+var KnownDivergences = []KnownDivergence{{
+	Impl:      ImplLibMacaroons2,
+	Behaviour: BehaviourUnusedDischarge,
+	Reason:    "does not check unused",
+}, {
+	Impl:      ImplPyMacaroons2,
+	Behaviour: BehaviourUnusedDischarge,
+	Reason:    "does not check unused",
+}, {
+	Impl:      ImplPyMacaroons3,
+	Behaviour: BehaviourUnusedDischarge,
+	Reason:    "does not check unused",
+}, {
+	Impl:      ImplLibMacaroons2,
+	Behaviour: BehaviourDischargeReuse,
+	Reason:    "doesn't check multiple use",
+}, {
+	Impl:      ImplPyMacaroons2,
+	Behaviour: BehaviourDischargeReuse,
+	Reason:    "doesn't check multiple use",
+}, {
+	Impl:      ImplPyMacaroons3,
+	Behaviour: BehaviourDischargeReuse,
+	Reason:    "doesn't check multiple use",
+}, {
+	Impl:      ImplLibMacaroons2,
+	Behaviour: BehaviourLastDuplicateDischarge,
+	Reason:    "only checks the last discharge macaroon with a given id (arguably correctly)",
+}, {
+	Impl:      ImplPyMacaroons2,
+	Behaviour: BehaviourFirstDuplicateDischarge,
+	Reason:    "only checks the first discharge macaroon with a given id (arguably correctly)",
+}, {
+	Impl:      ImplPyMacaroons3,
+	Behaviour: BehaviourFirstDuplicateDischarge,
+	Reason:    "only checks the first discharge macaroon with a given id (arguably correctly)",
+}, {
+	Impl:      ImplLibMacaroons2,
+	Behaviour: BehaviourRandomNonce,
+	Reason:    "cannot fake random nonce generator",
+}, {
+	Impl:      ImplLibMacaroons2,
+	Behaviour: BehaviourNoJSONV1,
+	Reason:    "libmacaroons doesn't currently support the V1 JSON format; see https://github.com/rescrv/libmacaroons/issues/49",
+}, {
+	Impl:      ImplGoV1,
+	Behaviour: BehaviourNoJSONV2,
+	Reason:    "macaroon.v1 supports only the version 1 formats, which cannot hold binary ids",
+}, {
+	Impl:      ImplLibMacaroons2,
+	Behaviour: BehaviourNoBinary,
+	Reason:    "binary format not implemented by the compatibility wrapper",
+}, {
+	Impl:      ImplJSMacaroon,
+	Behaviour: BehaviourNoBinary,
+	Reason:    "binary format not implemented by the compatibility wrapper",
+}, {
+	Impl:      ImplPyMacaroons2,
+	Behaviour: BehaviourNoBinary,
+	Reason:    "binary format not implemented by the compatibility wrapper",
+}, {
+	Impl:      ImplPyMacaroons3,
+	Behaviour: BehaviourNoBinary,
+	Reason:    "binary format not implemented by the compatibility wrapper",
+}}
+
+// LookupDivergence returns the known divergence, if any, that
+// causes the given version of an implementation to exhibit
+// any of the given behaviours.
+func LookupDivergence(impl Implementation, version string, behaviours []Behaviour) (KnownDivergence, bool) {
+	for _, d := range KnownDivergences {
+		if d.Impl != impl || !d.matchVersion(version) {
+			continue
+		}
+		for _, b := range behaviours {
+			if d.Behaviour == b {
+				return d, true
+			}
+		}
+	}
+	return KnownDivergence{}, false
+}
+
+func (d KnownDivergence) matchVersion(version string) bool {
+	if d.Versions == "" {
+		return true
+	}
+	ok, err := regexp.MatchString("^(?:"+d.Versions+")$", version)
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	mcompat "github.com/go-macaroon/macarooncompat"
+)
+
+type divergenceSuite struct{}
+
+var _ = gc.Suite(&divergenceSuite{})
+
+var lookupDivergenceTests = []struct {
+	about      string
+	impl       mcompat.Implementation
+	version    string
+	behaviours []mcompat.Behaviour
+	expect     string
+}{{
+	about:      "all versions",
+	impl:       mcompat.ImplGoV1,
+	version:    "anything",
+	behaviours: []mcompat.Behaviour{mcompat.BehaviourNoBinary},
+	expect:     "all",
+}, {
+	about:      "matching version",
+	impl:       mcompat.ImplGoV2,
+	version:    "1.2.3",
+	behaviours: []mcompat.Behaviour{mcompat.BehaviourNoBinary},
+	expect:     "old",
+}, {
+	about:      "alternative version",
+	impl:       mcompat.ImplGoV2,
+	version:    "1.3",
+	behaviours: []mcompat.Behaviour{mcompat.BehaviourNoBinary},
+	expect:     "old",
+}, {
+	about:      "version must match in full",
+	impl:       mcompat.ImplGoV2,
+	version:    "11.2.3",
+	behaviours: []mcompat.Behaviour{mcompat.BehaviourNoBinary},
+}, {
+	about:      "alternative must match in full",
+	impl:       mcompat.ImplGoV2,
+	version:    "1.3.1",
+	behaviours: []mcompat.Behaviour{mcompat.BehaviourNoBinary},
+}, {
+	about:      "non-matching version",
+	impl:       mcompat.ImplGoV2,
+	version:    "2.0.0",
+	behaviours: []mcompat.Behaviour{mcompat.BehaviourNoBinary},
+}, {
+	about:      "other behaviour",
+	impl:       mcompat.ImplGoV2,
+	version:    "1.2.3",
+	behaviours: []mcompat.Behaviour{mcompat.BehaviourNoJSONV1},
+}, {
+	about:      "any of several behaviours",
+	impl:       mcompat.ImplGoV2,
+	version:    "1.2.3",
+	behaviours: []mcompat.Behaviour{mcompat.BehaviourNoJSONV1, mcompat.BehaviourNoBinary},
+	expect:     "old",
+}}
+
+func (*divergenceSuite) TestLookupDivergence(c *gc.C) {
+	defer func(old []mcompat.KnownDivergence) {
+		mcompat.KnownDivergences = old
+	}(mcompat.KnownDivergences)
+	mcompat.KnownDivergences = []mcompat.KnownDivergence{{
+		Impl:      mcompat.ImplGoV1,
+		Behaviour: mcompat.BehaviourNoBinary,
+		Reason:    "all",
+	}, {
+		Impl:      mcompat.ImplGoV2,
+		Behaviour: mcompat.BehaviourNoBinary,
+		Versions:  `1\.2\..*|1\.3`,
+		Reason:    "old",
+	}}
+	for i, test := range lookupDivergenceTests {
+		c.Logf("test %d: %s", i, test.about)
+		d, ok := mcompat.LookupDivergence(test.impl, test.version, test.behaviours)
+		c.Assert(ok, gc.Equals, test.expect != "")
+		c.Assert(d.Reason, gc.Equals, test.expect)
+	}
+}
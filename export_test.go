@@ -0,0 +1,53 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+var (
+	NewSessionRecorder = newSessionRecorder
+	NewSessionPlayer   = newSessionPlayer
+)
+
+func (r *sessionRecorder) Record(expr string, response []byte) error {
+	return r.record(expr, response)
+}
+
+func (p *sessionPlayer) Next(expr string) ([]byte, error) {
+	return p.next(expr)
+}
+
+// CurrentSessionMode returns the arguments to the
+// most recent call to SetSessionMode.
+func CurrentSessionMode() (SessionMode, string) {
+	return sessionMode, sessionDir
+}
+
+// RawInterp gives access to an interpreter without
+// any macaroon library loaded into it.
+type RawInterp struct {
+	i *interp
+}
+
+// NewRawJSInterp returns an interpreter running js/interp.js.
+func NewRawJSInterp() RawInterp {
+	return RawInterp{newJSInterp().interp}
+}
+
+func (r RawInterp) Eval(expr string, resultVal interface{}) error {
+	return r.i.eval(expr, resultVal)
+}
+
+func (r RawInterp) EvalBatch(exprs []string, resultVals []interface{}) error {
+	return r.i.evalBatch(exprs, resultVals)
+}
+
+// Running reports whether an interpreter process is running.
+func (r RawInterp) Running() bool {
+	return r.i.process != nil
+}
+
+func (r RawInterp) Close() {
+	if r.i.process != nil {
+		r.i.kill()
+	}
+}
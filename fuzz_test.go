@@ -0,0 +1,147 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+//go:build go1.18
+// +build go1.18
+
+package macarooncompat_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	mcompat "github.com/go-macaroon/macarooncompat"
+)
+
+// FuzzDifferential generates random sets of macaroons and checks,
+// runs them through all the selected implementations and fails
+// if they disagree on any signature, serialized form or verification
+// outcome. Run it with:
+//
+//	go test -run '^$' -fuzz FuzzDifferential
+func FuzzDifferential(f *testing.F) {
+	runner := newFuzzRunner(f, 2)
+	f.Add([]byte{})
+	f.Add([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	f.Add([]byte{2, 1, 0, 4, 0, 0, 3, 0, 1, 1, 0, 2, 0})
+	f.Add([]byte{0, 0, 0, 4, 0, 5, 0, 0, 1, 0, 0, 1, 2, 0, 3, 0, 3, 2})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v := mcompat.GenerateVerifyVector(data)
+		v.About = fmt.Sprintf("generated from %x", data)
+		errs := runner.RunDifferential(v)
+		for _, err := range errs {
+			t.Error(err)
+		}
+		if len(errs) > 0 {
+			logShrunk(t, runner, v)
+		}
+	})
+}
+
+// FuzzProperties checks that every implementation satisfies
+// all the invariants in mcompat.Properties for generated
+// macaroons, independently of the other implementations.
+func FuzzProperties(f *testing.F) {
+	runner := newFuzzRunner(f, 1)
+	f.Add([]byte{})
+	f.Add([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	f.Add([]byte{2, 1, 0, 4, 0, 0, 3, 0, 1, 1, 0, 2, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v := mcompat.GenerateVerifyVector(data)
+		v.About = fmt.Sprintf("generated from %x", data)
+		for _, err := range runner.RunProperties(v) {
+			t.Error(err)
+		}
+	})
+}
+
+// logShrunk logs a minimal corpus entry that reproduces a
+// disagreement between the first implementation and another
+// on the given vector.
+func logShrunk(t *testing.T, runner *mcompat.Runner, v mcompat.VerifyVector) {
+	for _, impl := range runner.Impls[1:] {
+		shrunk, err := runner.Shrink(v, runner.Impls[0].Name, impl.Name)
+		if err != nil {
+			continue
+		}
+		var buf bytes.Buffer
+		mcompat.WriteCorpus(&buf, &mcompat.Corpus{
+			Verify: []mcompat.VerifyVector{shrunk},
+		})
+		t.Logf("minimal reproducer for %s and %s:\n%s", runner.Impls[0].Name, impl.Name, buf.Bytes())
+		return
+	}
+}
+
+// FuzzUnmarshalJSON mutates JSON-serialized macaroons from the
+// corpus and fails if the implementations disagree on whether
+// the result is valid, or if any of them crashes or hangs.
+func FuzzUnmarshalJSON(f *testing.F) {
+	fuzzUnmarshal(f, mcompat.FormatJSON)
+}
+
+// FuzzUnmarshalBinary is like FuzzUnmarshalJSON
+// but uses the binary format.
+func FuzzUnmarshalBinary(f *testing.F) {
+	fuzzUnmarshal(f, mcompat.FormatBinary)
+}
+
+func fuzzUnmarshal(f *testing.F, format mcompat.Format) {
+	runner := newFuzzRunner(f, 2)
+	corpus, err := mcompat.LoadCorpus(*corpusFlag)
+	if err != nil {
+		f.Fatal(err)
+	}
+	// Use the reference implementation to serialize
+	// the macaroons in the corpus as the seeds.
+	impls, err := mcompat.SelectImplementations([]string{string(mcompat.ImplGoV1)}, nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, mspec := range corpus.Macaroons() {
+		m, err := mcompat.MakeMacaroon(impls[0].Pkg, mspec)
+		if err != nil {
+			f.Fatal(err)
+		}
+		var data []byte
+		if format == mcompat.FormatJSON {
+			data, err = m.MarshalJSON()
+		} else {
+			data, err = m.MarshalBinary()
+		}
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, err := range runner.RunUnmarshal(fmt.Sprintf("%q", data), format, data) {
+			t.Error(err)
+		}
+	})
+}
+
+// newFuzzRunner returns a runner for the implementations
+// selected by the command line flags, skipping the fuzz test if
+// fewer than minImpls of them are available. The results are not
+// recorded in a report.
+func newFuzzRunner(f *testing.F, minImpls int) *mcompat.Runner {
+	impls, err := selectedImpls()
+	if err != nil {
+		f.Fatal(err)
+	}
+	runner, err := mcompat.NewRunner(impls)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for name, err := range runner.Unavailable {
+		f.Logf("skipping unavailable implementation %s: %v", name, err)
+	}
+	if len(runner.Impls) < minImpls {
+		f.Skipf("need at least %d available implementations", minImpls)
+	}
+	runner.Report = nil
+	f.Cleanup(mcompat.UseDeterministicNonces())
+	return runner
+}
@@ -0,0 +1,167 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"fmt"
+	"sort"
+)
+
+// generateConditions holds the first party conditions used
+// by GenerateVerifyVector. There are few of them so that
+// the same condition is often used more than once.
+var generateConditions = []string{
+	"account = 3735928559",
+	"time < 2015-01-01T00:00",
+	"email = alice@example.org",
+	"op read",
+	"op write",
+	"declared user bob",
+	"time-before 2015-01-01T00:00:00Z",
+	"time-before 2030-01-01T00:00:00Z",
+}
+
+// generatePredicates holds the predicates that
+// GenerateVerifyVector may add to a check.
+var generatePredicates = []Predicate{
+	{Op: OpPrefix, Arg: "op "},
+	{Op: OpPrefix, Arg: "declared "},
+	{Op: OpTimeBefore, Arg: "2020-06-01T12:00:00Z"},
+	{Op: OpTimeLessThan, Arg: "2014-06-01T12:00:00Z"},
+}
+
+const (
+	// maxGenerateCaveats holds the maximum number of caveats
+	// that GenerateVerifyVector adds to a single macaroon.
+	maxGenerateCaveats = 4
+
+	// maxGenerateDepth holds the maximum depth of third party
+	// caveats in discharge macaroons generated by
+	// GenerateVerifyVector.
+	maxGenerateDepth = 3
+
+	// maxGenerateChecks holds the maximum number of checks
+	// generated by GenerateVerifyVector.
+	maxGenerateChecks = 3
+)
+
+// GenerateVerifyVector generates a verify vector from the
+// given data, which is treated as a sequence of arbitrary choices,
+// so that the same data always generates the same vector. It is
+// intended to be used with fuzz testing; all data is valid.
+//
+// The primary macaroon may have first and third party caveats,
+// and there is usually a discharge macaroon for each third party
+// caveat, which may itself have caveats. Each check is satisfied
+// by a subset of the first party conditions. The generated checks
+// have no expected results; RunDifferential only checks that all
+// implementations agree.
+func GenerateVerifyVector(data []byte) VerifyVector {
+	g := &generator{
+		data: data,
+	}
+	var v VerifyVector
+	primary := MacaroonSpec{
+		RootKey:  fmt.Sprintf("root key %d", g.intn(3)),
+		Id:       fmt.Sprintf("id %d", g.intn(3)),
+		Location: fmt.Sprintf("http://primary%d.example.com", g.intn(2)),
+	}
+	primary.Caveats = g.caveats(0)
+	v.Macaroons = append([]MacaroonSpec{primary}, g.discharges...)
+	conds := make(map[string]bool)
+	for _, m := range v.Macaroons {
+		for _, cav := range m.Caveats {
+			if cav.Location == "" {
+				conds[cav.Condition] = true
+			}
+		}
+	}
+	var condList []string
+	for cond := range conds {
+		condList = append(condList, cond)
+	}
+	sort.Strings(condList)
+	nchecks := 1 + g.intn(maxGenerateChecks)
+	for i := 0; i < nchecks; i++ {
+		check := VerifyCheck{
+			Conditions: make(Conditions),
+		}
+		for _, cond := range condList {
+			if g.intn(4) != 0 {
+				check.Conditions[cond] = true
+			}
+		}
+		for _, pred := range generatePredicates {
+			if g.intn(4) == 0 {
+				check.Predicates = append(check.Predicates, pred)
+			}
+		}
+		v.Checks = append(v.Checks, check)
+	}
+	return v
+}
+
+// generator makes choices from a sequence of bytes.
+type generator struct {
+	data []byte
+
+	// discharges holds the discharge macaroons
+	// generated so far.
+	discharges []MacaroonSpec
+
+	// thirdPartyCount holds the number of third party
+	// caveats generated so far. It is used to make
+	// the caveat ids unique.
+	thirdPartyCount int
+}
+
+// intn returns a number in the range [0, n) taken from
+// the data. It returns zero when the data is exhausted.
+func (g *generator) intn(n int) int {
+	if len(g.data) == 0 {
+		return 0
+	}
+	x := int(g.data[0]) % n
+	g.data = g.data[1:]
+	return x
+}
+
+// caveats returns some caveats for a macaroon at the given
+// depth in the tree of discharges, adding discharge macaroons
+// for any third party caveats to g.discharges.
+func (g *generator) caveats(depth int) []CaveatSpec {
+	var caveats []CaveatSpec
+	n := g.intn(maxGenerateCaveats + 1)
+	for i := 0; i < n; i++ {
+		if depth >= maxGenerateDepth || g.intn(3) != 0 {
+			caveats = append(caveats, CaveatSpec{
+				Condition: generateConditions[g.intn(len(generateConditions))],
+			})
+			continue
+		}
+		g.thirdPartyCount++
+		cav := CaveatSpec{
+			Condition: fmt.Sprintf("third party caveat %d", g.thirdPartyCount),
+			Location:  fmt.Sprintf("http://thirdparty%d.example.com", g.intn(2)),
+			RootKey:   fmt.Sprintf("third party key %d", g.thirdPartyCount),
+		}
+		caveats = append(caveats, cav)
+		// Leave out the discharge occasionally so that
+		// verification fails.
+		if g.intn(6) == 0 {
+			continue
+		}
+		discharge := MacaroonSpec{
+			RootKey:  cav.RootKey,
+			Id:       cav.Condition,
+			Location: cav.Location,
+		}
+		// Add the discharge before generating its caveats
+		// so that the discharges are in a predictable order.
+		index := len(g.discharges)
+		g.discharges = append(g.discharges, discharge)
+		g.discharges[index].Caveats = g.caveats(depth + 1)
+	}
+	return caveats
+}
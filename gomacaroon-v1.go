@@ -4,6 +4,8 @@
 package macarooncompat
 
 import (
+	"encoding/json"
+
 	"gopkg.in/macaroon.v1"
 )
 
@@ -45,6 +47,19 @@ func (m goMacaroonV1) Verify(rootKey []byte, check Checker, discharges []Macaroo
 	return m.Macaroon.Verify(rootKey, check.Check, discharges1)
 }
 
+func (m goMacaroonV1) VerifyConditions(rootKey []byte, discharges []Macaroon) ([]string, error) {
+	return verifyConditions(m, rootKey, discharges)
+}
+
+// Caveats implements Macaroon.Caveats. The verification
+// ids are not exposed by macaroon.v1, so they are read from
+// the JSON serialization instead.
+func (m goMacaroonV1) Caveats() ([]Caveat, error) {
+	return caveatsFromJSON(m)
+}
+
+func (m goMacaroonV1) Free() {}
+
 type goMacaroonV1Package struct{}
 
 func (goMacaroonV1Package) New(rootKey []byte, id, loc string) (Macaroon, error) {
@@ -55,6 +70,14 @@ func (goMacaroonV1Package) New(rootKey []byte, id, loc string) (Macaroon, error)
 	return goMacaroonV1{m}, nil
 }
 
+func (goMacaroonV1Package) Available() error {
+	return nil
+}
+
+func (goMacaroonV1Package) LibraryVersion() (string, error) {
+	return "gopkg.in/macaroon.v1", nil
+}
+
 func (goMacaroonV1Package) UnmarshalJSON(data []byte) (Macaroon, error) {
 	var m macaroon.Macaroon
 	if err := m.UnmarshalJSON(data); err != nil {
@@ -70,3 +93,32 @@ func (goMacaroonV1Package) UnmarshalBinary(data []byte) (Macaroon, error) {
 	}
 	return goMacaroonV1{&m}, nil
 }
+
+func (goMacaroonV1Package) MarshalSlice(ms []Macaroon, format Format) ([]byte, error) {
+	s := make(macaroon.Slice, len(ms))
+	for i, m := range ms {
+		s[i] = m.(goMacaroonV1).Macaroon
+	}
+	if format == FormatBinary {
+		return s.MarshalBinary()
+	}
+	return json.Marshal(s)
+}
+
+func (goMacaroonV1Package) UnmarshalSlice(data []byte, format Format) ([]Macaroon, error) {
+	var s macaroon.Slice
+	var err error
+	if format == FormatBinary {
+		err = s.UnmarshalBinary(data)
+	} else {
+		err = json.Unmarshal(data, &s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]Macaroon, len(s))
+	for i, m := range s {
+		ms[i] = goMacaroonV1{m}
+	}
+	return ms, nil
+}
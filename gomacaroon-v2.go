@@ -4,6 +4,8 @@
 package macarooncompat
 
 import (
+	"encoding/json"
+
 	"gopkg.in/macaroon.v2-unstable"
 )
 
@@ -45,6 +47,28 @@ func (m goMacaroonV2) Verify(rootKey []byte, check Checker, discharges []Macaroo
 	return m.Macaroon.Verify(rootKey, check.Check, discharges1)
 }
 
+func (m goMacaroonV2) VerifyConditions(rootKey []byte, discharges []Macaroon) ([]string, error) {
+	discharges1 := make([]*macaroon.Macaroon, len(discharges))
+	for i, m := range discharges {
+		discharges1[i] = m.(goMacaroonV2).Macaroon
+	}
+	return m.Macaroon.VerifySignature(rootKey, discharges1)
+}
+
+func (m goMacaroonV2) Caveats() ([]Caveat, error) {
+	var caveats []Caveat
+	for _, cav := range m.Macaroon.Caveats() {
+		caveats = append(caveats, Caveat{
+			Id:             cav.Id,
+			VerificationId: cav.VerificationId,
+			Location:       cav.Location,
+		})
+	}
+	return caveats, nil
+}
+
+func (m goMacaroonV2) Free() {}
+
 type goMacaroonV2Package struct{}
 
 func (goMacaroonV2Package) New(rootKey []byte, id, loc string) (Macaroon, error) {
@@ -55,6 +79,14 @@ func (goMacaroonV2Package) New(rootKey []byte, id, loc string) (Macaroon, error)
 	return goMacaroonV2{m}, nil
 }
 
+func (goMacaroonV2Package) Available() error {
+	return nil
+}
+
+func (goMacaroonV2Package) LibraryVersion() (string, error) {
+	return "gopkg.in/macaroon.v2-unstable", nil
+}
+
 func (goMacaroonV2Package) UnmarshalJSON(data []byte) (Macaroon, error) {
 	var m macaroon.Macaroon
 	if err := m.UnmarshalJSON(data); err != nil {
@@ -70,3 +102,32 @@ func (goMacaroonV2Package) UnmarshalBinary(data []byte) (Macaroon, error) {
 	}
 	return goMacaroonV2{&m}, nil
 }
+
+func (goMacaroonV2Package) MarshalSlice(ms []Macaroon, format Format) ([]byte, error) {
+	s := make(macaroon.Slice, len(ms))
+	for i, m := range ms {
+		s[i] = m.(goMacaroonV2).Macaroon
+	}
+	if format == FormatBinary {
+		return s.MarshalBinary()
+	}
+	return json.Marshal(s)
+}
+
+func (goMacaroonV2Package) UnmarshalSlice(data []byte, format Format) ([]Macaroon, error) {
+	var s macaroon.Slice
+	var err error
+	if format == FormatBinary {
+		err = s.UnmarshalBinary(data)
+	} else {
+		err = json.Unmarshal(data, &s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]Macaroon, len(s))
+	for i, m := range s {
+		ms[i] = goMacaroonV2{m}
+	}
+	return ms, nil
+}
@@ -3,10 +3,6 @@
 
 package macarooncompat
 
-import (
-	"fmt"
-)
-
 type Macaroon interface {
 	MarshalJSON() ([]byte, error)
 	MarshalBinary() ([]byte, error)
@@ -14,21 +10,65 @@ type Macaroon interface {
 	WithThirdPartyCaveat(rootKey []byte, caveatId string, loc string) (Macaroon, error)
 	Bind(primary Macaroon) (Macaroon, error)
 	Verify(rootKey []byte, check Checker, discharges []Macaroon) error
+
+	// VerifyConditions verifies the signatures of the macaroon
+	// and the given discharges without checking any first party
+	// caveats, and returns the conditions of all the first
+	// party caveats in them.
+	VerifyConditions(rootKey []byte, discharges []Macaroon) ([]string, error)
+
 	Signature() []byte
+
+	// Caveats returns the caveats of the macaroon in the
+	// order they were added, including the raw verification
+	// ids of its third party caveats.
+	Caveats() ([]Caveat, error)
+
+	// Free releases any resources held on behalf of the macaroon
+	// by the implementation. The macaroon must not be used
+	// after Free has been called.
+	Free()
 }
 
-type Checker map[string]bool
+// Caveat holds a caveat as stored in a macaroon.
+type Caveat struct {
+	Id []byte
+
+	// VerificationId holds the verification id of a third
+	// party caveat. It is nil for first party caveats.
+	VerificationId []byte
 
-func (c Checker) Check(cav string) error {
-	if c[cav] {
-		return nil
-	}
-	return fmt.Errorf("condition %q not met", cav)
+	Location string
 }
 
 type Package interface {
+	// Available reports whether the implementation can be used.
+	// For implementations that rely on an external runtime, this
+	// starts the runtime if necessary and returns an error if it
+	// or the macaroon library it uses is not installed.
+	Available() error
+
+	// LibraryVersion returns the version of the macaroon
+	// library used by the implementation. It returns the
+	// empty string if the library does not record its
+	// version, and an error if the version cannot be
+	// obtained, for example because the runtime that
+	// runs the library has failed.
+	LibraryVersion() (string, error)
+
 	UnmarshalJSON(data []byte) (Macaroon, error)
 	UnmarshalBinary(data []byte) (Macaroon, error)
+
+	// MarshalSlice serializes the given macaroons, which must
+	// have been created by the implementation, as a single
+	// slice: a JSON array of macaroons or, in the binary format,
+	// the concatenation of their binary serializations.
+	MarshalSlice(ms []Macaroon, format Format) ([]byte, error)
+
+	// UnmarshalSlice deserializes a slice of macaroons
+	// serialized as by MarshalSlice.
+	UnmarshalSlice(data []byte, format Format) ([]Macaroon, error)
+
 	New(rootKey []byte, id, loc string) (Macaroon, error)
 }
 
@@ -43,10 +83,13 @@ const (
 	ImplPyMacaroons3  Implementation = "pymacaroons3"
 )
 
-var Implementations = []struct {
+// Impl associates an implementation with its name.
+type Impl struct {
 	Name Implementation
 	Pkg  Package
-}{{
+}
+
+var Implementations = []Impl{{
 	Name: ImplGoV1,
 	Pkg:  goMacaroonV1Package{},
 }, {
@@ -6,23 +6,33 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	errgo "gopkg.in/errgo.v1"
 )
 
 type pyInterp struct {
 	interp *interp
+
+	// freed holds the names of variables that are no longer
+	// referred to from Go. They are deleted from the interpreter
+	// as part of the next evaluation.
+	freed []string
 }
 
 // newPyInterp returns an interpreter instance that will run the
-// given python version (either 2 or 3).
-func newPyInterp(version int) *pyInterp {
+// given python version (either 2 or 3). The name is used
+// to identify the interpreter's session file.
+func newPyInterp(name string, version int) *pyInterp {
+	i := newInterp(name, fmt.Sprintf("python%d", version), "./python/interp.py")
+	i.batchCall = "result = batch([%s])"
 	return &pyInterp{
-		interp: newInterp(fmt.Sprintf("python%d", version), "./python/interp.py"),
+		interp: i,
 	}
 }
 
@@ -30,9 +40,35 @@ func (i *pyInterp) eval(expr string, resultVal interface{}) error {
 	if err := i.start(); err != nil {
 		return fmt.Errorf("cannot start pyinterp: %v", err)
 	}
+	if len(i.freed) > 0 {
+		expr = fmt.Sprintf("free(%s)\n%s", pyNames(i.freed), expr)
+		i.freed = i.freed[:0]
+	}
 	return i.interp.eval(expr, resultVal)
 }
 
+// evalBatch is like interp.evalBatch except that it
+// also deletes any freed variables.
+func (i *pyInterp) evalBatch(exprs []string, resultVals []interface{}) error {
+	if err := i.start(); err != nil {
+		return fmt.Errorf("cannot start pyinterp: %v", err)
+	}
+	if len(i.freed) > 0 {
+		exprs = append([]string{fmt.Sprintf("free(%s)", pyNames(i.freed))}, exprs...)
+		if resultVals != nil {
+			resultVals = append([]interface{}{nil}, resultVals...)
+		}
+		i.freed = i.freed[:0]
+	}
+	return i.interp.evalBatch(exprs, resultVals)
+}
+
+// free arranges for the variable with the given name
+// to be deleted on the next call to eval.
+func (i *pyInterp) free(name string) {
+	i.freed = append(i.freed, name)
+}
+
 func (i *pyInterp) started() bool {
 	return i.interp.started()
 }
@@ -59,6 +95,16 @@ func newPyName(s string) string {
 	return fmt.Sprintf("%s%d", s, n)
 }
 
+// pyNames returns the given names as a comma-separated
+// list of Python string literals.
+func pyNames(names []string) string {
+	vals := make([]string, len(names))
+	for i, name := range names {
+		vals[i] = pyVal(name)
+	}
+	return strings.Join(vals, ", ")
+}
+
 func pyImportSym(imp string) string {
 	return strings.Split(imp, ".")[0]
 }
@@ -76,28 +122,90 @@ func pyVal(v interface{}) string {
 	}
 }
 
+var (
+	// ErrInterpCrashed is the cause of the error returned when an
+	// interpreter process exits unexpectedly. The interpreter is
+	// restarted when it is next used, and any values held in it
+	// are lost.
+	ErrInterpCrashed = errgo.New("interpreter crashed")
+
+	// ErrInterpTimeout is the cause of the error returned when an
+	// interpreter process does not respond within EvalTimeout.
+	// The process is killed and restarted when it is next used.
+	ErrInterpTimeout = errgo.New("interpreter timed out")
+)
+
+// EvalTimeout holds the maximum time that an interpreter
+// may take to evaluate a single expression.
+var EvalTimeout = time.Minute
+
 type interp struct {
-	cmd    string
-	args   []string
-	stdin  io.Writer
-	stdout *bufio.Scanner
+	name    string
+	cmd     string
+	args    []string
+	process *exec.Cmd
+	stdin   io.Writer
+	stdout  *bufio.Scanner
+
+	// recorder holds the session recorder when
+	// recording a session.
+	recorder *sessionRecorder
+
+	// player holds the session player when replaying
+	// a session. When it is set, no external command is run.
+	player *sessionPlayer
+
+	// roundTrips holds the number of round trips
+	// made to the interpreter.
+	roundTrips int
+
+	// callTimeout, if non-zero, holds the time to wait for
+	// responses instead of EvalTimeout. It is set only for
+	// the duration of a call to withTimeout.
+	callTimeout time.Duration
+
+	// batchCall holds a format string that produces the
+	// statement that calls the interpreter's batch function
+	// when given a comma-separated list of string literals.
+	batchCall string
 }
 
-func newInterp(cmd string, args ...string) *interp {
+func newInterp(name string, cmd string, args ...string) *interp {
 	return &interp{
+		name: name,
 		cmd:  cmd,
 		args: args,
 	}
 }
 
 func (i *interp) started() bool {
-	return i.stdin != nil
+	return i.stdin != nil || i.player != nil
 }
 
 func (i *interp) start() error {
 	if i.started() {
 		return nil
 	}
+	switch sessionMode {
+	case SessionReplay:
+		player, err := newSessionPlayer(i.name)
+		if err != nil {
+			return errgo.Notef(err, "cannot replay session")
+		}
+		i.player = player
+		return nil
+	case SessionRecord:
+		if i.recorder != nil {
+			// The interpreter is being restarted after a crash;
+			// carry on recording to the same session.
+			break
+		}
+		recorder, err := newSessionRecorder(i.name)
+		if err != nil {
+			return errgo.Notef(err, "cannot record session")
+		}
+		i.recorder = recorder
+	}
 	log.Printf("starting %q %q", i.cmd, i.args)
 	cmd := exec.Command(i.cmd, i.args...)
 	cmd.Stderr = os.Stderr
@@ -117,9 +225,20 @@ func (i *interp) start() error {
 		i.stdin = nil
 		return err
 	}
+	i.process = cmd
 	return nil
 }
 
+// kill kills the interpreter process so that
+// it will be started again when next used.
+func (i *interp) kill() {
+	i.process.Process.Kill()
+	i.process.Wait()
+	i.process = nil
+	i.stdin = nil
+	i.stdout = nil
+}
+
 // eval evaluates the expression or statement in expr and unmarshals
 // any result into resultVal if resultVal is non-nil.
 func (i *interp) eval(expr string, resultVal interface{}) error {
@@ -127,25 +246,10 @@ func (i *interp) eval(expr string, resultVal interface{}) error {
 		return fmt.Errorf("cannot start interp: %v", err)
 	}
 	log.Printf("eval: %s", expr)
-	data := make([]byte, base64.StdEncoding.EncodedLen(len(expr))+1)
-	base64.StdEncoding.Encode(data, []byte(expr))
-	data[len(data)-1] = '\n'
-	if _, err := i.stdin.Write(data); err != nil {
-		return err
-	}
-	if !i.stdout.Scan() {
-		if err := i.stdout.Err(); err != nil {
-			return err
-		}
-		return io.ErrUnexpectedEOF
-	}
-	line := i.stdout.Bytes()
-	resultData := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
-	n, err := base64.StdEncoding.Decode(resultData, line)
+	resultData, err := i.roundTrip(expr)
 	if err != nil {
-		return errgo.Notef(err, "cannot decode base64")
+		return err
 	}
-	resultData = resultData[0:n]
 	var result struct {
 		Result    json.RawMessage `json:"result"`
 		Exception interface{}     `json:"exception"`
@@ -163,3 +267,211 @@ func (i *interp) eval(expr string, resultVal interface{}) error {
 	}
 	return nil
 }
+
+// evalBatch evaluates all the given expressions in a single round trip
+// and unmarshals the result of each into the corresponding element of
+// resultVals if resultVals is non-nil and that element is non-nil.
+// Evaluation stops at the first expression that fails.
+func (i *interp) evalBatch(exprs []string, resultVals []interface{}) error {
+	args := make([]string, len(exprs))
+	for j, expr := range exprs {
+		args[j] = fmt.Sprintf("%q", base64.StdEncoding.EncodeToString([]byte(expr)))
+	}
+	var results []struct {
+		Result    json.RawMessage `json:"result"`
+		Exception interface{}     `json:"exception"`
+	}
+	if err := i.eval(fmt.Sprintf(i.batchCall, strings.Join(args, ", ")), &results); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	for j, result := range results {
+		if result.Exception != nil {
+			return fmt.Errorf("eval error on %q: %#v", exprs[j], result.Exception)
+		}
+		if resultVals == nil || resultVals[j] == nil {
+			continue
+		}
+		if err := json.Unmarshal(result.Result, resultVals[j]); err != nil {
+			return fmt.Errorf("cannot unmarshal return result: %v", err)
+		}
+	}
+	if len(results) != len(exprs) {
+		return fmt.Errorf("batch returned %d results, expected %d", len(results), len(exprs))
+	}
+	return nil
+}
+
+// roundTrip sends the given expression to the interpreter
+// and returns its JSON-encoded response, recording or replaying
+// the exchange as required by the session mode.
+func (i *interp) roundTrip(expr string) ([]byte, error) {
+	i.roundTrips++
+	if i.player != nil {
+		return i.player.next(expr)
+	}
+	data := make([]byte, base64.StdEncoding.EncodedLen(len(expr))+1)
+	base64.StdEncoding.Encode(data, []byte(expr))
+	data[len(data)-1] = '\n'
+	if _, err := i.stdin.Write(data); err != nil {
+		i.kill()
+		return nil, errgo.WithCausef(err, ErrInterpCrashed, "cannot write to %s", i.name)
+	}
+	line, err := i.readLine()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrInterpCrashed), errgo.Is(ErrInterpTimeout))
+	}
+	resultData := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(resultData, line)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decode base64")
+	}
+	resultData = resultData[0:n]
+	if i.recorder != nil {
+		if err := i.recorder.record(expr, resultData); err != nil {
+			return nil, err
+		}
+	}
+	return resultData, nil
+}
+
+// resetPeakMemory resets the peak resident set size
+// of the interpreter process, so that memoryUsage reports
+// the peak from now on.
+func (i *interp) resetPeakMemory() error {
+	if i.process == nil {
+		return errgo.New("interpreter not running")
+	}
+	return resetPeakMemory(i.process.Process.Pid)
+}
+
+// memoryUsage returns the current and peak resident set
+// sizes of the interpreter process in bytes.
+func (i *interp) memoryUsage() (current, peak int64, err error) {
+	if i.process == nil {
+		return 0, 0, errgo.New("interpreter not running")
+	}
+	return memoryUsage(i.process.Process.Pid)
+}
+
+// resetPeakMemory resets the peak resident set size of
+// the process with the given id. It is only supported on Linux.
+func resetPeakMemory(pid int) error {
+	path := fmt.Sprintf("/proc/%d/clear_refs", pid)
+	return ioutil.WriteFile(path, []byte("5"), 0)
+}
+
+// memoryUsage returns the current and peak resident set sizes
+// in bytes of the process with the given id. It is only
+// supported on Linux.
+func memoryUsage(pid int) (current, peak int64, err error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, 0, errgo.Mask(err)
+	}
+	found := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		var dest *int64
+		switch {
+		case strings.HasPrefix(line, "VmRSS:"):
+			dest = &current
+		case strings.HasPrefix(line, "VmHWM:"):
+			dest = &peak
+		default:
+			continue
+		}
+		var kb int64
+		if _, err := fmt.Sscanf(line[strings.Index(line, ":")+1:], "%d kB", &kb); err != nil {
+			return 0, 0, errgo.Notef(err, "cannot parse %q", line)
+		}
+		*dest = kb * 1024
+		found++
+	}
+	if found != 2 {
+		return 0, 0, errgo.New("no memory usage found")
+	}
+	return current, peak, nil
+}
+
+// withTimeout calls f, waiting at most the given time for each
+// response from the interpreter that f evaluates instead of
+// EvalTimeout.
+func (i *interp) withTimeout(timeout time.Duration, f func() error) error {
+	i.callTimeout = timeout
+	defer func() {
+		i.callTimeout = 0
+	}()
+	return f()
+}
+
+// timeout returns the time to wait for a response.
+func (i *interp) timeout() time.Duration {
+	if i.callTimeout != 0 {
+		return i.callTimeout
+	}
+	return EvalTimeout
+}
+
+// readLine reads a line from the interpreter, killing the interpreter
+// if it fails to respond within its timeout or its output ends.
+func (i *interp) readLine() ([]byte, error) {
+	type scanResult struct {
+		line []byte
+		err  error
+	}
+	stdout := i.stdout
+	done := make(chan scanResult, 1)
+	go func() {
+		if !stdout.Scan() {
+			err := stdout.Err()
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			done <- scanResult{err: err}
+			return
+		}
+		done <- scanResult{line: stdout.Bytes()}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			i.kill()
+			return nil, errgo.WithCausef(r.err, ErrInterpCrashed, "%s exited unexpectedly", i.name)
+		}
+		return r.line, nil
+	case <-time.After(i.timeout()):
+		i.kill()
+		return nil, errgo.WithCausef(nil, ErrInterpTimeout, "%s did not respond within %v", i.name, i.timeout())
+	}
+}
+
+// RoundTrips returns the number of round trips that have been made
+// to the interpreter that runs the given package's implementation.
+// It returns zero for implementations that do not use an interpreter.
+func RoundTrips(pkg Package) int {
+	if ipkg, ok := pkg.(interpPackage); ok {
+		return ipkg.interpreter().roundTrips
+	}
+	return 0
+}
+
+// RoundTripOverhead measures the mean time taken by n round trips to
+// the interpreter that runs the given package's implementation when
+// evaluating an empty expression. It returns zero for implementations
+// that do not use an interpreter.
+func RoundTripOverhead(pkg Package, n int) (time.Duration, error) {
+	ipkg, ok := pkg.(interpPackage)
+	if !ok {
+		return 0, nil
+	}
+	if err := pkg.Available(); err != nil {
+		return 0, errgo.Mask(err)
+	}
+	i := ipkg.interpreter()
+	t0 := time.Now()
+	for j := 0; j < n; j++ {
+		if err := i.eval("", nil); err != nil {
+			return 0, errgo.Mask(err)
+		}
+	}
+	return time.Since(t0) / time.Duration(n), nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat_test
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+
+	mcompat "github.com/go-macaroon/macarooncompat"
+)
+
+type interpSuite struct{}
+
+var _ = gc.Suite(&interpSuite{})
+
+// largeFrameSize is larger than the chunks in which
+// node delivers data read from stdin.
+const largeFrameSize = 300 * 1024
+
+func (*interpSuite) TestJSInterpLargeFrame(c *gc.C) {
+	if _, err := exec.LookPath("node"); err != nil {
+		c.Skip("node not installed")
+	}
+	if mode, _ := mcompat.CurrentSessionMode(); mode != mcompat.SessionLive {
+		c.Skip("not running live")
+	}
+	i := mcompat.NewRawJSInterp()
+	defer i.Close()
+	var n int
+	err := i.Eval(fmt.Sprintf("%q.length", strings.Repeat("x", largeFrameSize)), &n)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, largeFrameSize)
+
+	// The interpreter must still be in step afterwards.
+	err = i.Eval("1+1", &n)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 2)
+
+	exprs := make([]string, 5000)
+	results := make([]interface{}, len(exprs))
+	for j := range exprs {
+		exprs[j] = fmt.Sprintf("%d", j)
+		results[j] = new(int)
+	}
+	err = i.EvalBatch(exprs, results)
+	c.Assert(err, gc.IsNil)
+	c.Assert(*results[len(results)-1].(*int), gc.Equals, len(exprs)-1)
+}
+
+func (*interpSuite) TestLargeMacaroon(c *gc.C) {
+	impls, err := selectedImpls()
+	c.Assert(err, gc.IsNil)
+	// Each macaroon is built in a single round trip,
+	// so each of these is sent in one large frame.
+	many := mcompat.MacaroonSpec{
+		RootKey: "root-key",
+		Id:      "root-id",
+	}
+	for j := 0; j < 1000; j++ {
+		many.Caveats = append(many.Caveats, mcompat.CaveatSpec{
+			Condition: fmt.Sprintf("caveat %d", j),
+		})
+	}
+	huge := mcompat.MacaroonSpec{
+		RootKey: "root-key",
+		Id:      "root-id",
+		Caveats: []mcompat.CaveatSpec{{
+			Condition: strings.Repeat("x", largeFrameSize),
+		}},
+	}
+	for _, impl := range impls {
+		if impl.Pkg.Available() != nil {
+			continue
+		}
+		for _, mspec := range []mcompat.MacaroonSpec{many, huge} {
+			c.Logf("implementation %s, %d caveats", impl.Name, len(mspec.Caveats))
+			m, err := mcompat.MakeMacaroon(impl.Pkg, mspec)
+			c.Assert(err, gc.IsNil)
+			conds, err := m.VerifyConditions([]byte(mspec.RootKey), nil)
+			m.Free()
+			c.Assert(err, gc.IsNil)
+			c.Assert(conds, gc.HasLen, len(mspec.Caveats))
+		}
+	}
+}
@@ -17,24 +17,30 @@
 
 var sys = require("sys");
 
-var stdin = process.openStdin();
-var currentBuf = new Buffer(0);
-var state = {}
-stdin.on("data", function(d) {
-    var i, line, result;
-    currentBuf = Buffer.concat([currentBuf, d]);
-    for(i = 0; i < currentBuf.length; i++){
-        if(d[i] === 10){
-            // We've found a newline (10 == '\n'), so use the line up to this point.
-            line = currentBuf.slice(0, i);
-            currentBuf = currentBuf.slice(i + 1);
+// batch evaluates each of the given base64-encoded expressions in turn
+// and returns an array holding the result of each, stopping after the
+// first one that throws an exception.
+var batch = function(exprs) {
+    var i, result, results = [];
+    for(i = 0; i < exprs.length; i++){
+        result = {};
+        try {
+            result.result = eval((new Buffer(exprs[i], 'base64')).toString('utf8'));
+        } catch (err) {
+            result.exception = err.message;
+        }
+        results.push(result);
+        if(result.exception !== undefined){
             break;
         }
     }
-    if(line === undefined){
-        return;
-    }
-    result = {};
+    return results;
+};
+
+// evalLine evaluates the base64-encoded expression in the given
+// line and writes the result to stdout.
+var evalLine = function(line) {
+    var result = {};
     line = (new Buffer(line.toString(), 'base64')).toString('utf8');
     try {
         result.result = eval(line);
@@ -42,4 +48,23 @@ stdin.on("data", function(d) {
         result.exception = err.message;
     }
     console.log((new Buffer(JSON.stringify(result))).toString('base64'));
+};
+
+var stdin = process.openStdin();
+var currentBuf = new Buffer(0);
+var state = {}
+stdin.on("data", function(d) {
+    var i, start = 0;
+    currentBuf = Buffer.concat([currentBuf, d]);
+    // A line may span several chunks of data and a chunk
+    // may hold several lines. Earlier chunks have already
+    // been searched for newlines.
+    for(i = currentBuf.length - d.length; i < currentBuf.length; i++){
+        if(currentBuf[i] === 10){
+            // We've found a newline (10 == '\n'), so use the line up to this point.
+            evalLine(currentBuf.slice(start, i));
+            start = i + 1;
+        }
+    }
+    currentBuf = currentBuf.slice(start);
 });
@@ -20,15 +20,66 @@ func (jsMacaroonPkg) New(rootKey []byte, id, loc string) (Macaroon, error) {
 	m := &jsMacaroon{
 		name: newJSName("m"),
 	}
-	expr := fmt.Sprintf(`%s = state.macaroon.newMacaroon({
+	if err := jsRunner.eval(jsNewExpr(m.name, rootKey, id, loc), nil); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// build implements macaroonBuilder by sending the
+// creation of the macaroon and all its caveats
+// to the interpreter as a single batch.
+func (jsMacaroonPkg) build(mspec MacaroonSpec) (Macaroon, error) {
+	m := &jsMacaroon{
+		name: newJSName("m"),
+	}
+	exprs := []string{jsNewExpr(m.name, []byte(mspec.RootKey), mspec.Id, mspec.Location)}
+	for _, cav := range mspec.Caveats {
+		if cav.Location != "" {
+			exprs = append(exprs, jsThirdPartyExpr(m.name, []byte(cav.RootKey), cav.Condition, cav.Location))
+		} else {
+			exprs = append(exprs, jsFirstPartyExpr(m.name, cav.Condition))
+		}
+	}
+	if err := jsRunner.evalBatch(exprs, nil); err != nil {
+		m.Free()
+		return nil, err
+	}
+	return m, nil
+}
+
+func jsNewExpr(name string, rootKey []byte, id, loc string) string {
+	return fmt.Sprintf(`%s = state.macaroon.newMacaroon({
 		rootKey: %s,
 		identifier: %s,
 		location: %s,
-	})`, m.name, jsVal([]byte(rootKey)), jsVal(id), jsVal(loc))
-	if err := jsRunner.eval(expr, nil); err != nil {
-		return nil, err
+	})`, name, jsVal(rootKey), jsVal(id), jsVal(loc))
+}
+
+func jsFirstPartyExpr(name string, caveatId string) string {
+	return fmt.Sprintf(`%s.addFirstPartyCaveat(%s)`, name, jsVal(caveatId))
+}
+
+func jsThirdPartyExpr(name string, rootKey []byte, caveatId string, loc string) string {
+	return fmt.Sprintf(`%s.addThirdPartyCaveat(%s, %s, %s)`,
+		name, jsVal(rootKey), jsVal(caveatId), jsVal(loc))
+}
+
+func (jsMacaroonPkg) Available() error {
+	return jsRunner.start()
+}
+
+func (jsMacaroonPkg) LibraryVersion() (string, error) {
+	var r string
+	if err := jsRunner.eval(`require("macaroon/package.json").version`, &r); err != nil {
+		return "", err
 	}
-	return m, nil
+	return r, nil
+}
+
+// interpreter returns the node interpreter that runs the macaroon package.
+func (jsMacaroonPkg) interpreter() *interp {
+	return jsRunner.interp
 }
 
 func (jsMacaroonPkg) UnmarshalJSON(data []byte) (Macaroon, error) {
@@ -46,6 +97,20 @@ func (jsMacaroonPkg) UnmarshalBinary(data []byte) (Macaroon, error) {
 	return nil, fmt.Errorf("unimplemented")
 }
 
+func (p jsMacaroonPkg) MarshalSlice(ms []Macaroon, format Format) ([]byte, error) {
+	if format == FormatBinary {
+		return nil, fmt.Errorf("unimplemented")
+	}
+	return marshalJSONSlice(ms)
+}
+
+func (p jsMacaroonPkg) UnmarshalSlice(data []byte, format Format) ([]Macaroon, error) {
+	if format == FormatBinary {
+		return nil, fmt.Errorf("unimplemented")
+	}
+	return unmarshalJSONSlice(p, data)
+}
+
 type jsMacaroon struct {
 	name string
 }
@@ -76,9 +141,7 @@ func (m *jsMacaroon) MarshalBinary() ([]byte, error) {
 
 func (m *jsMacaroon) WithFirstPartyCaveat(caveatId string) (Macaroon, error) {
 	m = m.clone()
-	expr := fmt.Sprintf(`%s.addFirstPartyCaveat(%s)`,
-		m.name, jsVal(caveatId))
-	if err := jsRunner.eval(expr, nil); err != nil {
+	if err := jsRunner.eval(jsFirstPartyExpr(m.name, caveatId), nil); err != nil {
 		return nil, err
 	}
 	return m, nil
@@ -86,9 +149,7 @@ func (m *jsMacaroon) WithFirstPartyCaveat(caveatId string) (Macaroon, error) {
 
 func (m *jsMacaroon) WithThirdPartyCaveat(rootKey []byte, caveatId string, loc string) (Macaroon, error) {
 	m = m.clone()
-	expr := fmt.Sprintf(`%s.addThirdPartyCaveat(%s, %s, %s)`,
-		m.name, jsVal(rootKey), jsVal(caveatId), jsVal(loc))
-	if err := jsRunner.eval(expr, nil); err != nil {
+	if err := jsRunner.eval(jsThirdPartyExpr(m.name, rootKey, caveatId, loc), nil); err != nil {
 		return nil, err
 	}
 	return m, nil
@@ -109,17 +170,43 @@ func (m *jsMacaroon) Verify(rootKey []byte, check Checker, discharges []Macaroon
 	for i, m := range discharges {
 		dischargeNames[i] = m.(*jsMacaroon).name
 	}
-	checkFunc := fmt.Sprintf(`function(cav) {
-		var table = %s;
-		if(table[cav] === true){
-			return null;
-		}
-		return new Error("condition not satisfied")
-	}`, jsVal(check))
-	expr := fmt.Sprintf(`%s.verify(%s, %s, [%s])`, m.name, jsVal(rootKey), checkFunc, strings.Join(dischargeNames, ", "))
+	expr := fmt.Sprintf(`%s.verify(%s, state.checkerFunc(%s), [%s])`, m.name, jsVal(rootKey), predicatesJSON(check), strings.Join(dischargeNames, ", "))
 	return jsRunner.eval(expr, nil)
 }
 
+// verifyTrace implements verifyTracer.
+func (m *jsMacaroon) verifyTrace(rootKey []byte, check Checker, discharges []Macaroon) (trace []string, verifyErr, err error) {
+	dischargeNames := make([]string, len(discharges))
+	for i, m := range discharges {
+		dischargeNames[i] = m.(*jsMacaroon).name
+	}
+	expr := fmt.Sprintf(`(function() {
+		var trace = [], check = state.checkerFunc(%s), err = null;
+		try {
+			%s.verify(%s, function(cond) {
+				trace.push(cond);
+				return check(cond);
+			}, [%s]);
+		} catch(e) {
+			err = e.message;
+		}
+		return {trace: trace, error: err};
+	})()`, predicatesJSON(check), m.name, jsVal(rootKey), strings.Join(dischargeNames, ", "))
+	var r traceResult
+	if err := jsRunner.eval(expr, &r); err != nil {
+		return nil, nil, err
+	}
+	return r.Trace, r.verifyError(), nil
+}
+
+func (m *jsMacaroon) VerifyConditions(rootKey []byte, discharges []Macaroon) ([]string, error) {
+	return verifyConditions(m, rootKey, discharges)
+}
+
+func (m *jsMacaroon) Caveats() ([]Caveat, error) {
+	return caveatsFromJSON(m)
+}
+
 func (m *jsMacaroon) Signature() []byte {
 	expr := fmt.Sprintf(`state.btoa(String.fromCharCode.apply(null, %s.signature))`, m.name)
 	var r string
@@ -134,6 +221,10 @@ func (m *jsMacaroon) Signature() []byte {
 	return data
 }
 
+func (m *jsMacaroon) Free() {
+	jsRunner.free(m.name)
+}
+
 var jsNameSeq = 0
 
 func newJSName(s string) string {
@@ -157,18 +248,35 @@ func jsVal(v interface{}) string {
 
 type jsInterp struct {
 	interp *interp
+
+	// freed holds the names of state properties that are no longer
+	// referred to from Go. They are deleted as part of the
+	// next evaluation.
+	freed []string
+
+	// startErr holds any error encountered when
+	// starting the interpreter.
+	startErr error
 }
 
 func newJSInterp() *jsInterp {
+	i := newInterp(string(ImplJSMacaroon), "js/interp.js")
+	i.batchCall = "batch([%s])"
 	return &jsInterp{
-		interp: newInterp("js/interp.js"),
+		interp: i,
 	}
 }
 
 func (i *jsInterp) start() error {
-	if i.interp.started() {
-		return nil
+	if i.interp.started() || i.startErr != nil {
+		return i.startErr
 	}
+	i.startErr = i.init()
+	return i.startErr
+}
+
+// init starts the interpreter and prepares it for use.
+func (i *jsInterp) init() error {
 	if err := i.interp.start(); err != nil {
 		return errgo.Mask(err)
 	}
@@ -189,6 +297,9 @@ func (i *jsInterp) start() error {
 	}`, nil); err != nil {
 		return fmt.Errorf("cannot define b64toUint8array")
 	}
+	if err := i.interp.eval(jsCheckerDef, nil); err != nil {
+		return fmt.Errorf("cannot define checkerFunc: %v", err)
+	}
 	return nil
 }
 
@@ -196,5 +307,31 @@ func (i *jsInterp) eval(expr string, resultVal interface{}) error {
 	if err := i.start(); err != nil {
 		return fmt.Errorf("cannot start jsinterp: %v", err)
 	}
+	if len(i.freed) > 0 {
+		expr = fmt.Sprintf("delete %s;\n%s", strings.Join(i.freed, ", delete "), expr)
+		i.freed = i.freed[:0]
+	}
 	return i.interp.eval(expr, resultVal)
 }
+
+// evalBatch is like interp.evalBatch except that it
+// also deletes any freed state properties.
+func (i *jsInterp) evalBatch(exprs []string, resultVals []interface{}) error {
+	if err := i.start(); err != nil {
+		return fmt.Errorf("cannot start jsinterp: %v", err)
+	}
+	if len(i.freed) > 0 {
+		exprs = append([]string{"delete " + strings.Join(i.freed, ", delete ")}, exprs...)
+		if resultVals != nil {
+			resultVals = append([]interface{}{nil}, resultVals...)
+		}
+		i.freed = i.freed[:0]
+	}
+	return i.interp.evalBatch(exprs, resultVals)
+}
+
+// free arranges for the state property with the given name
+// to be deleted on the next call to eval.
+func (i *jsInterp) free(name string) {
+	i.freed = append(i.freed, name)
+}
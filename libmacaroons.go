@@ -6,7 +6,6 @@ package macarooncompat
 import (
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"strings"
 
@@ -28,14 +27,48 @@ func (p libMacaroonsPkg) eval(expr string, result interface{}) error {
 
 func (p libMacaroonsPkg) New(rootKey []byte, id, loc string) (Macaroon, error) {
 	m := p.newMacaroon()
-	expr := fmt.Sprintf(`%s = macaroons.create(%s, %s, %s)`,
-		m.name, pyVal(loc), pyVal(rootKey), pyVal(id))
-	if err := p.eval(expr, nil); err != nil {
+	if err := p.eval(libNewExpr(m.name, rootKey, id, loc), nil); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// build implements macaroonBuilder. As libmacaroons
+// returns a new macaroon for each added caveat, each
+// caveat replaces the value of the same variable.
+func (p libMacaroonsPkg) build(mspec MacaroonSpec) (Macaroon, error) {
+	m := p.newMacaroon()
+	exprs := []string{libNewExpr(m.name, []byte(mspec.RootKey), mspec.Id, mspec.Location)}
+	for _, cav := range mspec.Caveats {
+		if cav.Location != "" {
+			exprs = append(exprs, libThirdPartyExpr(m.name, m.name, []byte(cav.RootKey), cav.Condition, cav.Location))
+		} else {
+			exprs = append(exprs, libFirstPartyExpr(m.name, m.name, cav.Condition))
+		}
+	}
+	if err := libMacaroonsRunner[p.version].evalBatch(exprs, nil); err != nil {
+		m.Free()
 		return nil, err
 	}
 	return m, nil
 }
 
+func libNewExpr(name string, rootKey []byte, id, loc string) string {
+	return fmt.Sprintf(`%s = macaroons.create(%s, %s, %s)`,
+		name, pyVal(loc), pyVal(rootKey), pyVal(id))
+}
+
+func libFirstPartyExpr(name, from string, caveatId string) string {
+	return fmt.Sprintf(`%s = %s.add_first_party_caveat(%s)`,
+		name, from, pyVal(caveatId))
+}
+
+func libThirdPartyExpr(name, from string, rootKey []byte, caveatId string, loc string) string {
+	// TODO specify nonce explicitly.
+	return fmt.Sprintf(`%s = %s.add_third_party_caveat(%s, %s, %s)`,
+		name, from, pyVal(loc), pyVal(rootKey), pyVal(caveatId))
+}
+
 func (p libMacaroonsPkg) newMacaroon() *libMacaroon {
 	return &libMacaroon{
 		p:    p,
@@ -43,6 +76,24 @@ func (p libMacaroonsPkg) newMacaroon() *libMacaroon {
 	}
 }
 
+func (p libMacaroonsPkg) Available() error {
+	return libMacaroonsRunner[p.version].start()
+}
+
+func (p libMacaroonsPkg) LibraryVersion() (string, error) {
+	var r string
+	if err := p.eval(`result = getattr(macaroons, '__version__', '')`, &r); err != nil {
+		return "", err
+	}
+	return r, nil
+}
+
+// interpreter returns the python interpreter that uses the
+// libmacaroons bindings.
+func (p libMacaroonsPkg) interpreter() *interp {
+	return libMacaroonsRunner[p.version].interp.interp
+}
+
 func (p libMacaroonsPkg) UnmarshalJSON(data []byte) (Macaroon, error) {
 	m := p.newMacaroon()
 	expr := fmt.Sprintf(`%s = macaroons.deserialize(%s)`, m.name, pyVal(base64.StdEncoding.EncodeToString(data)))
@@ -56,6 +107,20 @@ func (p libMacaroonsPkg) UnmarshalBinary(data []byte) (Macaroon, error) {
 	return nil, fmt.Errorf("unimplemented")
 }
 
+func (p libMacaroonsPkg) MarshalSlice(ms []Macaroon, format Format) ([]byte, error) {
+	if format == FormatBinary {
+		return nil, fmt.Errorf("unimplemented")
+	}
+	return marshalJSONSlice(ms)
+}
+
+func (p libMacaroonsPkg) UnmarshalSlice(data []byte, format Format) ([]Macaroon, error) {
+	if format == FormatBinary {
+		return nil, fmt.Errorf("unimplemented")
+	}
+	return unmarshalJSONSlice(p, data)
+}
+
 type libMacaroon struct {
 	p    libMacaroonsPkg
 	name string
@@ -76,9 +141,7 @@ func (m *libMacaroon) MarshalBinary() ([]byte, error) {
 
 func (m *libMacaroon) WithFirstPartyCaveat(caveatId string) (Macaroon, error) {
 	m1 := m.p.newMacaroon()
-	expr := fmt.Sprintf(`%s = %s.add_first_party_caveat(%s)`,
-		m1.name, m.name, pyVal(caveatId))
-	if err := m.p.eval(expr, nil); err != nil {
+	if err := m.p.eval(libFirstPartyExpr(m1.name, m.name, caveatId), nil); err != nil {
 		return nil, err
 	}
 	return m1, nil
@@ -86,10 +149,7 @@ func (m *libMacaroon) WithFirstPartyCaveat(caveatId string) (Macaroon, error) {
 
 func (m *libMacaroon) WithThirdPartyCaveat(rootKey []byte, caveatId string, loc string) (Macaroon, error) {
 	m1 := m.p.newMacaroon()
-	// TODO specify nonce explicitly.
-	expr := fmt.Sprintf(`%s = %s.add_third_party_caveat(%s, %s, %s)`,
-		m1.name, m.name, pyVal(loc), pyVal(rootKey), pyVal(caveatId))
-	if err := m.p.eval(expr, nil); err != nil {
+	if err := m.p.eval(libThirdPartyExpr(m1.name, m.name, rootKey, caveatId, loc), nil); err != nil {
 		return nil, err
 	}
 	return m1, nil
@@ -110,11 +170,39 @@ func (m *libMacaroon) Verify(rootKey []byte, check Checker, discharges []Macaroo
 	for i, m := range discharges {
 		dischargeNames[i] = m.(*libMacaroon).name
 	}
-	checkData, _ := json.Marshal(check)
-	expr := fmt.Sprintf(`bool_verifier(json.loads(%s)).verify(%s, %s, [%s])`, pyVal(string(checkData)), m.name, pyVal(rootKey), strings.Join(dischargeNames, ", "))
+	expr := fmt.Sprintf(`checker_verifier(macaroons.Verifier, json.loads(%s)).verify(%s, %s, [%s])`, pyVal(predicatesJSON(check)), m.name, pyVal(rootKey), strings.Join(dischargeNames, ", "))
 	return m.p.eval(expr, nil)
 }
 
+// verifyTrace implements verifyTracer.
+func (m *libMacaroon) verifyTrace(rootKey []byte, check Checker, discharges []Macaroon) (trace []string, verifyErr, err error) {
+	dischargeNames := make([]string, len(discharges))
+	for i, m := range discharges {
+		dischargeNames[i] = m.(*libMacaroon).name
+	}
+	expr := fmt.Sprintf(`
+trace, err = [], None
+try:
+	checker_verifier(macaroons.Verifier, json.loads(%s), trace).verify(%s, %s, [%s])
+except:
+	err = traceback.format_exc()
+result = {'trace': trace, 'error': err}
+`, pyVal(predicatesJSON(check)), m.name, pyVal(rootKey), strings.Join(dischargeNames, ", "))
+	var r traceResult
+	if err := m.p.eval(expr, &r); err != nil {
+		return nil, nil, err
+	}
+	return r.Trace, r.verifyError(), nil
+}
+
+func (m *libMacaroon) VerifyConditions(rootKey []byte, discharges []Macaroon) ([]string, error) {
+	return verifyConditions(m, rootKey, discharges)
+}
+
+func (m *libMacaroon) Caveats() ([]Caveat, error) {
+	return caveatsFromJSON(m)
+}
+
 func (m *libMacaroon) Signature() []byte {
 	expr := fmt.Sprintf(`result = %s.signature`, m.name)
 	var r string
@@ -129,13 +217,21 @@ func (m *libMacaroon) Signature() []byte {
 	return data
 }
 
+func (m *libMacaroon) Free() {
+	libMacaroonsRunner[m.p.version].interp.free(m.name)
+}
+
 type libMacaroonsInterp struct {
 	interp *pyInterp
+
+	// startErr holds any error encountered when
+	// starting the interpreter.
+	startErr error
 }
 
 func newLibMacaroonsInterp(version int) *libMacaroonsInterp {
 	return &libMacaroonsInterp{
-		interp: newPyInterp(version),
+		interp: newPyInterp(fmt.Sprintf("libmacaroons%d", version), version),
 	}
 }
 
@@ -146,10 +242,23 @@ func (i *libMacaroonsInterp) eval(expr string, resultVal interface{}) error {
 	return i.interp.eval(expr, resultVal)
 }
 
+func (i *libMacaroonsInterp) evalBatch(exprs []string, resultVals []interface{}) error {
+	if err := i.start(); err != nil {
+		return fmt.Errorf("cannot start pyinterp: %v", err)
+	}
+	return i.interp.evalBatch(exprs, resultVals)
+}
+
 func (i *libMacaroonsInterp) start() error {
-	if i.interp.started() {
-		return nil
+	if i.interp.started() || i.startErr != nil {
+		return i.startErr
 	}
+	i.startErr = i.init()
+	return i.startErr
+}
+
+// init starts the interpreter and prepares it for use.
+func (i *libMacaroonsInterp) init() error {
 	if err := i.interp.start(); err != nil {
 		return errgo.Mask(err)
 	}
@@ -158,15 +267,8 @@ func (i *libMacaroonsInterp) start() error {
 			return errgo.Notef(err, "cannot import %s", p)
 		}
 	}
-	boolVerifierDef := `
-global bool_verifier
-def bool_verifier(conds):
-	v = macaroons.Verifier()
-	v.satisfy_general(lambda cond: conds.get(cond, None))
-	return v
-`
-	if err := i.interp.eval(boolVerifierDef, nil); err != nil {
-		return errgo.Notef(err, "cannot define bool_verifier")
+	if err := i.interp.eval(pyCheckerDef, nil); err != nil {
+		return errgo.Notef(err, "cannot define checker_verifier")
 	}
 	return nil
 }
@@ -0,0 +1,252 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"bytes"
+	"fmt"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// Property describes an invariant that every implementation
+// must satisfy regardless of what the other implementations do.
+type Property struct {
+	// Name holds the name of the property.
+	Name string
+
+	// Check checks that the property holds for the macaroons and
+	// checks in the given vector when using the given implementation.
+	// It ignores any expected results in the vector. It returns
+	// an error describing the violation if it does not.
+	//
+	// The runner is used to look up known divergences.
+	Check func(r *Runner, impl Impl, v VerifyVector) error
+}
+
+// Properties holds all the properties checked by RunProperties.
+var Properties = []Property{{
+	Name:  "caveat-never-loosens",
+	Check: checkCaveatNeverLoosens,
+}, {
+	Name:  "wrong-root-key-fails",
+	Check: checkWrongRootKeyFails,
+}, {
+	Name:  "unbound-discharge-fails",
+	Check: checkUnboundDischargeFails,
+}, {
+	Name:  "serialization-round-trip",
+	Check: checkSerializationRoundTrip,
+}}
+
+// RunProperties checks that each implementation satisfies all
+// of Properties for the given vector, recording the result for
+// each property and implementation in the report. It returns an
+// error for each violation.
+func (r *Runner) RunProperties(v VerifyVector) []error {
+	r = r.supporting("properties: "+v.About, v.Macaroons...)
+	r.logf("property test: %s", v.About)
+	var errs []error
+	for _, p := range Properties {
+		check := fmt.Sprintf("property %s: %s", p.Name, v.About)
+		for _, impl := range r.Impls {
+			if err := p.Check(r, impl, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s %v", check, impl.Name, err))
+				r.add(check, impl.Name, Result{
+					Outcome: OutcomeFail,
+					Reason:  err.Error(),
+				})
+				continue
+			}
+			r.add(check, impl.Name, Result{Outcome: OutcomePass})
+		}
+	}
+	return errs
+}
+
+// checkCaveatNeverLoosens checks that adding a first party caveat
+// to any of the macaroons never causes a failing check to pass,
+// even when the new caveat's condition is satisfied.
+func checkCaveatNeverLoosens(r *Runner, impl Impl, v VerifyVector) error {
+	const extra = "extra caveat"
+	for j, check := range v.Checks {
+		ok, err := verifyMacaroons(impl.Pkg, v.Macaroons, check.Checker(), true)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if ok {
+			continue
+		}
+		conds := append(Predicates{{Op: OpExact, Arg: extra}}, check.Checker().Predicates()...)
+		for i := range v.Macaroons {
+			v1 := copyVerifyVector(v)
+			v1.Macaroons[i].Caveats = append(v1.Macaroons[i].Caveats, CaveatSpec{
+				Condition: extra,
+			})
+			ok, err := verifyMacaroons(impl.Pkg, v1.Macaroons, conds, true)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if ok {
+				return fmt.Errorf("check %d passes after adding a caveat to macaroon %d", j, i)
+			}
+		}
+	}
+	return nil
+}
+
+// checkWrongRootKeyFails checks that verification
+// always fails with the wrong root key.
+func checkWrongRootKeyFails(r *Runner, impl Impl, v VerifyVector) error {
+	wrongKey := []byte(v.Macaroons[0].RootKey + " wrong")
+	for j, check := range v.Checks {
+		_, macaroons, err := MakeMacaroons(impl.Pkg, v.Macaroons)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		err = macaroons[0].Verify(wrongKey, check.Checker(), macaroons[1:])
+		FreeAll(macaroons)
+		if err == nil {
+			return fmt.Errorf("check %d passes with the wrong root key", j)
+		}
+	}
+	return nil
+}
+
+// checkUnboundDischargeFails checks that any check that passes
+// fails when the discharge macaroons are not bound to the primary.
+// Vectors with unused or duplicate discharges are ignored because
+// some implementations accept those regardless of binding.
+func checkUnboundDischargeFails(r *Runner, impl Impl, v VerifyVector) error {
+	if len(v.Macaroons) < 2 || !dischargesUsedOnce(v.Macaroons) {
+		return nil
+	}
+	for j, check := range v.Checks {
+		ok, err := verifyMacaroons(impl.Pkg, v.Macaroons, check.Checker(), true)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if !ok {
+			continue
+		}
+		ok, err = verifyMacaroons(impl.Pkg, v.Macaroons, check.Checker(), false)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if ok {
+			return fmt.Errorf("check %d passes with unbound discharges", j)
+		}
+	}
+	return nil
+}
+
+// dischargesUsedOnce reports whether each discharge macaroon in ms
+// has a unique id that is used by a third party caveat.
+func dischargesUsedOnce(ms []MacaroonSpec) bool {
+	cavIds := make(map[string]bool)
+	for _, m := range ms {
+		for _, cav := range m.Caveats {
+			if cav.Location != "" {
+				cavIds[cav.Condition] = true
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	for _, m := range ms[1:] {
+		if !cavIds[m.Id] || seen[m.Id] {
+			return false
+		}
+		seen[m.Id] = true
+	}
+	return true
+}
+
+// checkSerializationRoundTrip checks that unmarshaling a marshaled
+// macaroon produces a macaroon that marshals to the same data,
+// in all the formats supported by the implementation.
+func checkSerializationRoundTrip(r *Runner, impl Impl, v VerifyVector) error {
+	for _, format := range []Format{FormatJSON, FormatBinary} {
+		if _, ok := r.KnownDivergence(impl.Name, format.unsupported()); ok {
+			continue
+		}
+		for i, mspec := range v.Macaroons {
+			m, err := MakeMacaroon(impl.Pkg, mspec)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			err = checkRoundTrip(impl.Pkg, m, format)
+			m.Free()
+			if err != nil {
+				return fmt.Errorf("macaroon %d: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+func checkRoundTrip(pkg Package, m Macaroon, format Format) error {
+	data, err := marshal(m, format)
+	if err != nil {
+		return fmt.Errorf("cannot marshal %s: %v", format, err)
+	}
+	m1, err := unmarshal(pkg, data, format)
+	if m1 != nil {
+		defer m1.Free()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal %s %q: %v", format, data, err)
+	}
+	data1, err := marshal(m1, format)
+	if err != nil {
+		return fmt.Errorf("cannot marshal unmarshaled %s: %v", format, err)
+	}
+	if !bytes.Equal(data1, data) {
+		return fmt.Errorf("%s round trip changed %q to %q", format, data, data1)
+	}
+	if sig, sig1 := m.Signature(), m1.Signature(); !bytes.Equal(sig1, sig) {
+		return fmt.Errorf("%s round trip changed signature from %x to %x", format, sig, sig1)
+	}
+	return nil
+}
+
+func marshal(m Macaroon, format Format) ([]byte, error) {
+	if format == FormatBinary {
+		return m.MarshalBinary()
+	}
+	return m.MarshalJSON()
+}
+
+func unmarshal(pkg Package, data []byte, format Format) (Macaroon, error) {
+	if format == FormatBinary {
+		return pkg.UnmarshalBinary(data)
+	}
+	return pkg.UnmarshalJSON(data)
+}
+
+// verifyMacaroons creates the given macaroons with the given package,
+// binding the discharges to the primary if bind is true, and reports
+// whether they verify with the given checker. It returns an error
+// only if the macaroons cannot be created.
+func verifyMacaroons(pkg Package, mspecs []MacaroonSpec, check Checker, bind bool) (bool, error) {
+	var macaroons []Macaroon
+	var err error
+	if bind {
+		_, macaroons, err = MakeMacaroons(pkg, mspecs)
+	} else {
+		for _, mspec := range mspecs {
+			var m Macaroon
+			m, err = MakeMacaroon(pkg, mspec)
+			if err != nil {
+				break
+			}
+			macaroons = append(macaroons, m)
+		}
+	}
+	defer FreeAll(macaroons)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	err = macaroons[0].Verify([]byte(mspecs[0].RootKey), check, macaroons[1:])
+	return err == nil, nil
+}
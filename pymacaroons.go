@@ -6,7 +6,6 @@ package macarooncompat
 import (
 	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"strings"
 
@@ -28,14 +27,51 @@ func (p pyMacaroonsPkg) eval(expr string, result interface{}) error {
 
 func (p pyMacaroonsPkg) New(rootKey []byte, id, loc string) (Macaroon, error) {
 	m := p.newMacaroon()
-	expr := fmt.Sprintf(`%s = pymacaroons.Macaroon(location=%s, identifier=%s, key=%s)`,
-		m.name, pyVal(loc), pyVal(id), pyVal(rootKey))
-	if err := p.eval(expr, nil); err != nil {
+	if err := p.eval(pyNewExpr(m.name, rootKey, id, loc), nil); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// build implements macaroonBuilder by creating the macaroon
+// and adding all its caveats in a single batch.
+func (p pyMacaroonsPkg) build(mspec MacaroonSpec) (Macaroon, error) {
+	m := p.newMacaroon()
+	exprs := []string{pyNewExpr(m.name, []byte(mspec.RootKey), mspec.Id, mspec.Location)}
+	for _, cav := range mspec.Caveats {
+		if cav.Location != "" {
+			exprs = append(exprs, pyThirdPartyExpr(m.name, []byte(cav.RootKey), cav.Condition, cav.Location))
+		} else {
+			exprs = append(exprs, pyFirstPartyExpr(m.name, cav.Condition))
+		}
+	}
+	if err := pyMacaroonsRunner[p.version].evalBatch(exprs, nil); err != nil {
+		m.Free()
 		return nil, err
 	}
 	return m, nil
 }
 
+func pyNewExpr(name string, rootKey []byte, id, loc string) string {
+	return fmt.Sprintf(`%s = pymacaroons.Macaroon(location=%s, identifier=%s, key=%s)`,
+		name, pyVal(loc), pyVal(id), pyVal(rootKey))
+}
+
+func pyFirstPartyExpr(name string, caveatId string) string {
+	return fmt.Sprintf(`%s.add_first_party_caveat(%s)`, name, pyVal(caveatId))
+}
+
+func pyThirdPartyExpr(name string, rootKey []byte, caveatId string, loc string) string {
+	// Read the nonce explicitly from crypto/rand so that it can
+	// be patched by the tests
+	nonce := make([]byte, 24)
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf(`%s.add_third_party_caveat(%s, %s, %s, nonce=%s)`,
+		name, pyVal(loc), pyVal(rootKey), pyVal(caveatId), pyVal(nonce))
+}
+
 func (p pyMacaroonsPkg) newMacaroon() *pyMacaroon {
 	return &pyMacaroon{
 		p:    p,
@@ -43,6 +79,23 @@ func (p pyMacaroonsPkg) newMacaroon() *pyMacaroon {
 	}
 }
 
+func (p pyMacaroonsPkg) Available() error {
+	return pyMacaroonsRunner[p.version].start()
+}
+
+func (p pyMacaroonsPkg) LibraryVersion() (string, error) {
+	var r string
+	if err := p.eval(`result = getattr(pymacaroons, '__version__', '')`, &r); err != nil {
+		return "", err
+	}
+	return r, nil
+}
+
+// interpreter returns the interpreter that runs the implementation.
+func (p pyMacaroonsPkg) interpreter() *interp {
+	return pyMacaroonsRunner[p.version].interp.interp
+}
+
 func (p pyMacaroonsPkg) UnmarshalJSON(data []byte) (Macaroon, error) {
 	m := p.newMacaroon()
 	expr := fmt.Sprintf(`%s = pymacaroons.Macaroon.deserialize(%s, serializer=pymacaroons.serializers.JsonSerializer())`, m.name, pyVal(string(data)))
@@ -56,6 +109,20 @@ func (p pyMacaroonsPkg) UnmarshalBinary(data []byte) (Macaroon, error) {
 	return nil, fmt.Errorf("unimplemented")
 }
 
+func (p pyMacaroonsPkg) MarshalSlice(ms []Macaroon, format Format) ([]byte, error) {
+	if format == FormatBinary {
+		return nil, fmt.Errorf("unimplemented")
+	}
+	return marshalJSONSlice(ms)
+}
+
+func (p pyMacaroonsPkg) UnmarshalSlice(data []byte, format Format) ([]Macaroon, error) {
+	if format == FormatBinary {
+		return nil, fmt.Errorf("unimplemented")
+	}
+	return unmarshalJSONSlice(p, data)
+}
+
 type pyMacaroon struct {
 	p    pyMacaroonsPkg
 	name string
@@ -86,9 +153,7 @@ func (m *pyMacaroon) MarshalBinary() ([]byte, error) {
 
 func (m *pyMacaroon) WithFirstPartyCaveat(caveatId string) (Macaroon, error) {
 	m = m.clone()
-	expr := fmt.Sprintf(`%s.add_first_party_caveat(%s)`,
-		m.name, pyVal(caveatId))
-	if err := m.p.eval(expr, nil); err != nil {
+	if err := m.p.eval(pyFirstPartyExpr(m.name, caveatId), nil); err != nil {
 		return nil, err
 	}
 	return m, nil
@@ -96,15 +161,7 @@ func (m *pyMacaroon) WithFirstPartyCaveat(caveatId string) (Macaroon, error) {
 
 func (m *pyMacaroon) WithThirdPartyCaveat(rootKey []byte, caveatId string, loc string) (Macaroon, error) {
 	m = m.clone()
-	// Read the nonce explicitly from crypto/rand so that it can
-	// be patched by the tests
-	nonce := make([]byte, 24)
-	if _, err := rand.Read(nonce[:]); err != nil {
-		panic(err)
-	}
-	expr := fmt.Sprintf(`%s.add_third_party_caveat(%s, %s, %s, nonce=%s)`,
-		m.name, pyVal(loc), pyVal(rootKey), pyVal(caveatId), pyVal(nonce))
-	if err := m.p.eval(expr, nil); err != nil {
+	if err := m.p.eval(pyThirdPartyExpr(m.name, rootKey, caveatId, loc), nil); err != nil {
 		return nil, err
 	}
 	return m, nil
@@ -125,11 +182,39 @@ func (m *pyMacaroon) Verify(rootKey []byte, check Checker, discharges []Macaroon
 	for i, m := range discharges {
 		dischargeNames[i] = m.(*pyMacaroon).name
 	}
-	checkData, _ := json.Marshal(check)
-	expr := fmt.Sprintf(`bool_verifier(json.loads(%s)).verify(%s, %s, [%s])`, pyVal(string(checkData)), m.name, pyVal(rootKey), strings.Join(dischargeNames, ", "))
+	expr := fmt.Sprintf(`checker_verifier(pymacaroons.Verifier, json.loads(%s)).verify(%s, %s, [%s])`, pyVal(predicatesJSON(check)), m.name, pyVal(rootKey), strings.Join(dischargeNames, ", "))
 	return m.p.eval(expr, nil)
 }
 
+// verifyTrace implements verifyTracer.
+func (m *pyMacaroon) verifyTrace(rootKey []byte, check Checker, discharges []Macaroon) (trace []string, verifyErr, err error) {
+	dischargeNames := make([]string, len(discharges))
+	for i, m := range discharges {
+		dischargeNames[i] = m.(*pyMacaroon).name
+	}
+	expr := fmt.Sprintf(`
+trace, err = [], None
+try:
+	checker_verifier(pymacaroons.Verifier, json.loads(%s), trace).verify(%s, %s, [%s])
+except:
+	err = traceback.format_exc()
+result = {'trace': trace, 'error': err}
+`, pyVal(predicatesJSON(check)), m.name, pyVal(rootKey), strings.Join(dischargeNames, ", "))
+	var r traceResult
+	if err := m.p.eval(expr, &r); err != nil {
+		return nil, nil, err
+	}
+	return r.Trace, r.verifyError(), nil
+}
+
+func (m *pyMacaroon) VerifyConditions(rootKey []byte, discharges []Macaroon) ([]string, error) {
+	return verifyConditions(m, rootKey, discharges)
+}
+
+func (m *pyMacaroon) Caveats() ([]Caveat, error) {
+	return caveatsFromJSON(m)
+}
+
 func (m *pyMacaroon) Signature() []byte {
 	expr := fmt.Sprintf(`result = %s.signature`, m.name)
 	var r string
@@ -144,13 +229,21 @@ func (m *pyMacaroon) Signature() []byte {
 	return data
 }
 
+func (m *pyMacaroon) Free() {
+	pyMacaroonsRunner[m.p.version].interp.free(m.name)
+}
+
 type pyMacaroonsInterp struct {
 	interp *pyInterp
+
+	// startErr holds any error encountered when
+	// starting the interpreter.
+	startErr error
 }
 
 func newPyMacaroonsInterp(version int) *pyMacaroonsInterp {
 	return &pyMacaroonsInterp{
-		interp: newPyInterp(version),
+		interp: newPyInterp(fmt.Sprintf("pymacaroons%d", version), version),
 	}
 }
 
@@ -161,10 +254,23 @@ func (i *pyMacaroonsInterp) eval(expr string, resultVal interface{}) error {
 	return i.interp.eval(expr, resultVal)
 }
 
+func (i *pyMacaroonsInterp) evalBatch(exprs []string, resultVals []interface{}) error {
+	if err := i.start(); err != nil {
+		return fmt.Errorf("cannot start pyinterp: %v", err)
+	}
+	return i.interp.evalBatch(exprs, resultVals)
+}
+
 func (i *pyMacaroonsInterp) start() error {
-	if i.interp.started() {
-		return nil
+	if i.interp.started() || i.startErr != nil {
+		return i.startErr
 	}
+	i.startErr = i.init()
+	return i.startErr
+}
+
+// init starts the interpreter and prepares it for use.
+func (i *pyMacaroonsInterp) init() error {
 	if err := i.interp.start(); err != nil {
 		return errgo.Mask(err)
 	}
@@ -173,15 +279,8 @@ func (i *pyMacaroonsInterp) start() error {
 			return errgo.Notef(err, "cannot import %s", p)
 		}
 	}
-	boolVerifierDef := `
-global bool_verifier
-def bool_verifier(conds):
-	v = pymacaroons.Verifier()
-	v.satisfy_general(lambda cond: conds.get(cond, None))
-	return v
-`
-	if err := i.interp.eval(boolVerifierDef, nil); err != nil {
-		return errgo.Notef(err, "cannot define bool_verifier")
+	if err := i.interp.eval(pyCheckerDef, nil); err != nil {
+		return errgo.Notef(err, "cannot define checker_verifier")
 	}
 	return nil
 }
@@ -20,6 +20,36 @@ class StringIO(object):
 		return self.s
 
 vars={}
+
+# free deletes the named variables, ignoring any that
+# have not been defined. It is used to release objects
+# that are no longer referred to by the Go side.
+def free(*names):
+	for name in names:
+		vars.pop(name, None)
+
+# batch executes each of the base64-encoded statements in the given
+# list in turn and returns a list holding the result of each, stopping
+# after the first one that raises an exception. The statements are
+# passed as a single list because Python before 3.7 does not allow
+# calls with more than 255 arguments.
+def batch(exprs):
+	results = []
+	for expr in exprs:
+		result = {}
+		try:
+			vars["result"] = None
+			six.exec_(base64.b64decode(expr), globals(), vars)
+			result["result"] = vars["result"]
+		except:
+			f = StringIO()
+			traceback.print_exc(file=f)
+			result["exception"] = f.getvalue()
+		results.append(result)
+		if "exception" in result:
+			break
+	return results
+
 while True:
 	line=sys.stdin.readline()
 	if line == "":
@@ -0,0 +1,254 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	errgo "gopkg.in/errgo.v1"
+)
+
+// refMacaroon is a minimal macaroon implementation used to create
+// macaroons that the implementations cannot create through their
+// own APIs, such as those with binary ids or externally supplied
+// verification ids. The resulting macaroons are passed to the
+// implementations in the version 2 JSON format.
+type refMacaroon struct {
+	id       []byte
+	location string
+	caveats  []refCaveat
+	sig      [32]byte
+}
+
+type refCaveat struct {
+	id       []byte
+	vid      []byte
+	location string
+}
+
+var refKeyGen = []byte("macaroons-key-generator")
+
+// refMakeKey derives a fixed length key from a variable
+// length key in the same way as libmacaroons.
+func refMakeKey(key []byte) *[32]byte {
+	return refHash(refKeyGen, key)
+}
+
+func refHash(key, data []byte) *[32]byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return &sum
+}
+
+func newRefMacaroon(rootKey, id []byte, loc string) *refMacaroon {
+	return &refMacaroon{
+		id:       id,
+		location: loc,
+		sig:      *refHash(refMakeKey(rootKey)[:], id),
+	}
+}
+
+func (m *refMacaroon) addFirstPartyCaveat(cid []byte) {
+	m.caveats = append(m.caveats, refCaveat{
+		id: cid,
+	})
+	m.sig = *refHash(m.sig[:], cid)
+}
+
+// addThirdPartyCaveat adds a third party caveat with the given
+// verification id. If vid is nil, the caveat root key is encrypted
+// with the current signature as the key and a nonce derived from the
+// current signature and the caveat id.
+func (m *refMacaroon) addThirdPartyCaveat(rootKey, cid, vid []byte, loc string) {
+	if vid == nil {
+		var nonce [24]byte
+		copy(nonce[:], refHash(m.sig[:], cid)[:])
+		vid = secretbox.Seal(nonce[:], refMakeKey(rootKey)[:], &nonce, &m.sig)
+	}
+	m.caveats = append(m.caveats, refCaveat{
+		id:       cid,
+		vid:      vid,
+		location: loc,
+	})
+	h1 := refHash(m.sig[:], vid)
+	h2 := refHash(m.sig[:], cid)
+	m.sig = *refHash(m.sig[:], append(h1[:], h2[:]...))
+}
+
+type refCaveatJSON struct {
+	CID      string `json:"i,omitempty"`
+	CID64    string `json:"i64,omitempty"`
+	VID64    string `json:"v64,omitempty"`
+	Location string `json:"l,omitempty"`
+}
+
+type refMacaroonJSON struct {
+	Caveats      []refCaveatJSON `json:"c,omitempty"`
+	Location     string          `json:"l,omitempty"`
+	Identifier   string          `json:"i,omitempty"`
+	Identifier64 string          `json:"i64,omitempty"`
+	Signature64  string          `json:"s64"`
+}
+
+// MarshalJSON marshals the macaroon in the version 2 JSON format.
+func (m *refMacaroon) MarshalJSON() ([]byte, error) {
+	mjson := refMacaroonJSON{
+		Location:    m.location,
+		Signature64: base64.RawURLEncoding.EncodeToString(m.sig[:]),
+	}
+	putRefBinaryField(m.id, &mjson.Identifier, &mjson.Identifier64)
+	for _, cav := range m.caveats {
+		cjson := refCaveatJSON{
+			Location: cav.location,
+		}
+		putRefBinaryField(cav.id, &cjson.CID, &cjson.CID64)
+		if cav.vid != nil {
+			cjson.VID64 = base64.RawURLEncoding.EncodeToString(cav.vid)
+		}
+		mjson.Caveats = append(mjson.Caveats, cjson)
+	}
+	return json.Marshal(mjson)
+}
+
+// putRefBinaryField sets *s to x if it is valid UTF-8,
+// or sets *sb64 to its base64 encoding otherwise.
+func putRefBinaryField(x []byte, s, sb64 *string) {
+	if utf8.Valid(x) {
+		*s = string(x)
+	} else {
+		*sb64 = base64.RawURLEncoding.EncodeToString(x)
+	}
+}
+
+// makeRefMacaroon creates the macaroon specified by mspec, which
+// must have had its ids resolved by resolveIds, with the reference
+// implementation and unmarshals it with the given package.
+func makeRefMacaroon(pkg Package, mspec MacaroonSpec) (Macaroon, error) {
+	m := newRefMacaroon([]byte(mspec.RootKey), []byte(mspec.Id), mspec.Location)
+	for _, cav := range mspec.Caveats {
+		if cav.Location != "" {
+			m.addThirdPartyCaveat([]byte(cav.RootKey), []byte(cav.Condition), cav.VerificationId, cav.Location)
+		} else {
+			m.addFirstPartyCaveat([]byte(cav.Condition))
+		}
+	}
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	pm, err := pkg.UnmarshalJSON(data)
+	if err != nil {
+		if pm != nil {
+			pm.Free()
+		}
+		return nil, errgo.Notef(err, "cannot unmarshal reference macaroon")
+	}
+	return pm, nil
+}
+
+// makeRefMacaroons is like MakeMacaroons except that all the
+// macaroons are created with the reference implementation, and so
+// are in the version 2 format whatever format the implementation
+// would have used.
+func makeRefMacaroons(pkg Package, mspecs []MacaroonSpec) (rootKey []byte, macaroons []Macaroon, err error) {
+	return makeMacaroons(pkg, mspecs, func(pkg Package, mspec MacaroonSpec) (Macaroon, error) {
+		mspec, err := resolveIds(mspec)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		m, err := makeRefMacaroon(pkg, mspec)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot create macaroon")
+		}
+		return m, nil
+	})
+}
+
+// anyNeedsRef reports whether any of the given macaroons
+// can only be created with the reference implementation.
+func anyNeedsRef(mspecs ...MacaroonSpec) bool {
+	for _, mspec := range mspecs {
+		if mspec, err := resolveIds(mspec); err == nil && needsRef(mspec) {
+			return true
+		}
+	}
+	return false
+}
+
+// needsRef reports whether the given macaroon, which must have had
+// its ids resolved by resolveIds, can only be created with the
+// reference implementation.
+func needsRef(mspec MacaroonSpec) bool {
+	if !utf8.ValidString(mspec.Id) {
+		return true
+	}
+	for _, cav := range mspec.Caveats {
+		if cav.VerificationId != nil || !utf8.ValidString(cav.Condition) {
+			return true
+		}
+	}
+	return false
+}
+
+// openRefVerificationId decrypts the given verification id, which
+// holds a secretbox nonce followed by the sealed caveat root key,
+// using the given signature as the key.
+func openRefVerificationId(sig *[32]byte, vid []byte) ([]byte, error) {
+	var nonce [24]byte
+	if len(vid) < len(nonce)+secretbox.Overhead {
+		return nil, errgo.Newf("verification id too short (%d bytes)", len(vid))
+	}
+	copy(nonce[:], vid)
+	key, ok := secretbox.Open(nil, vid[len(nonce):], &nonce, sig)
+	if !ok {
+		return nil, errgo.New("cannot decrypt verification id")
+	}
+	return key, nil
+}
+
+// checkVerificationIds checks that the given caveats, read from a
+// macaroon created from mspec (which must have had its ids resolved by
+// resolveIds) and having the given signature, match mspec, and that
+// the verification id of each third party caveat decrypts to the
+// caveat's derived root key when using the signature of the macaroon
+// before the caveat was added, as recomputed by the reference
+// implementation, as the key.
+func checkVerificationIds(mspec MacaroonSpec, caveats []Caveat, sig []byte) error {
+	if len(caveats) != len(mspec.Caveats) {
+		return errgo.Newf("got %d caveats, want %d", len(caveats), len(mspec.Caveats))
+	}
+	m := newRefMacaroon([]byte(mspec.RootKey), []byte(mspec.Id), mspec.Location)
+	for i, cav := range caveats {
+		cspec := mspec.Caveats[i]
+		if string(cav.Id) != cspec.Condition {
+			return errgo.Newf("caveat %d has id %q, want %q", i, cav.Id, cspec.Condition)
+		}
+		if cspec.Location == "" {
+			if cav.VerificationId != nil {
+				return errgo.Newf("first party caveat %d has verification id %x", i, cav.VerificationId)
+			}
+			m.addFirstPartyCaveat(cav.Id)
+			continue
+		}
+		got, err := openRefVerificationId(&m.sig, cav.VerificationId)
+		if err != nil {
+			return errgo.Notef(err, "caveat %d", i)
+		}
+		if want := refMakeKey([]byte(cspec.RootKey)); !hmac.Equal(got, want[:]) {
+			return errgo.Newf("caveat %d: verification id holds key %x, want %x", i, got, want[:])
+		}
+		m.addThirdPartyCaveat(nil, cav.Id, cav.VerificationId, cav.Location)
+	}
+	if !hmac.Equal(sig, m.sig[:]) {
+		return errgo.Newf("signature %x does not match reference signature %x", sig, m.sig[:])
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// Outcome describes how an implementation fared in a check
+// compared with the others.
+type Outcome string
+
+const (
+	// OutcomePass means that the implementation behaved
+	// as expected.
+	OutcomePass Outcome = "pass"
+
+	// OutcomeFail means that the implementation behaved
+	// differently and the difference is not known.
+	OutcomeFail Outcome = "fail"
+
+	// OutcomeDivergent means that the implementation behaved
+	// differently as recorded in KnownDivergences.
+	OutcomeDivergent Outcome = "divergent"
+
+	// OutcomeUnexpectedPass means that the implementation
+	// behaved as expected despite a known divergence that
+	// should have caused it to behave differently.
+	OutcomeUnexpectedPass Outcome = "unexpected-pass"
+)
+
+// Result holds the result of a check for one implementation.
+type Result struct {
+	Outcome Outcome `json:"outcome"`
+
+	// Reason holds the reason for any outcome other than
+	// OutcomePass.
+	Reason string `json:"reason,omitempty"`
+}
+
+// ReportImpl describes an implementation included in a report.
+type ReportImpl struct {
+	Name    Implementation `json:"name"`
+	Version string         `json:"version,omitempty"`
+
+	// Unavailable holds the reason the implementation was
+	// not checked, if it was not available.
+	Unavailable string `json:"unavailable,omitempty"`
+}
+
+// ReportRow holds the results of a single check
+// across all implementations.
+type ReportRow struct {
+	Check   string                    `json:"check"`
+	Results map[Implementation]Result `json:"results"`
+}
+
+// Report holds a matrix of the results of compatibility checks
+// against implementations. It is safe to call its methods
+// concurrently.
+type Report struct {
+	mu              sync.Mutex
+	Implementations []ReportImpl `json:"implementations"`
+	Rows            []*ReportRow `json:"rows"`
+}
+
+// NewReport returns a new report for the given implementations.
+// The versions and unavailable maps hold the library version of each
+// implementation and the reason why any implementation is unavailable
+// respectively; either may be nil.
+func NewReport(impls []Impl, versions map[Implementation]string, unavailable map[Implementation]error) *Report {
+	r := &Report{}
+	for _, impl := range impls {
+		ri := ReportImpl{
+			Name:    impl.Name,
+			Version: versions[impl.Name],
+		}
+		if err := unavailable[impl.Name]; err != nil {
+			ri.Unavailable = err.Error()
+		}
+		r.Implementations = append(r.Implementations, ri)
+	}
+	return r
+}
+
+// Add records the result of the given check for an implementation.
+// Rows are kept in the order that checks were first added.
+func (r *Report) Add(check string, impl Implementation, result Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var row *ReportRow
+	for _, rrow := range r.Rows {
+		if rrow.Check == check {
+			row = rrow
+			break
+		}
+	}
+	if row == nil {
+		row = &ReportRow{
+			Check:   check,
+			Results: make(map[Implementation]Result),
+		}
+		r.Rows = append(r.Rows, row)
+	}
+	row.Results[impl] = result
+}
+
+// Failures returns the number of results in the report
+// with an outcome of OutcomeFail or OutcomeUnexpectedPass.
+func (r *Report) Failures() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, row := range r.Rows {
+		for _, result := range row.Results {
+			if result.Outcome == OutcomeFail || result.Outcome == OutcomeUnexpectedPass {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// WriteJSON writes the report to w in JSON format.
+func (r *Report) WriteJSON(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// WriteMarkdown writes the report to w as a Markdown table.
+func (r *Report) WriteMarkdown(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var buf bytes.Buffer
+	buf.WriteString("| Check |")
+	for _, impl := range r.Implementations {
+		fmt.Fprintf(&buf, " %s |", markdownEscape(impl.title()))
+	}
+	buf.WriteString("\n|---|")
+	for range r.Implementations {
+		buf.WriteString("---|")
+	}
+	buf.WriteString("\n")
+	for _, row := range r.Rows {
+		fmt.Fprintf(&buf, "| %s |", markdownEscape(row.Check))
+		for _, impl := range r.Implementations {
+			fmt.Fprintf(&buf, " %s |", markdownEscape(row.cell(impl)))
+		}
+		buf.WriteString("\n")
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// WriteHTML writes the report to w as an HTML document.
+func (r *Report) WriteHTML(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return reportTemplate.Execute(w, r)
+}
+
+// WriteFile writes the report to the named file. The format
+// is chosen by the file's extension: .json, .md or .html.
+func (r *Report) WriteFile(path string) error {
+	var write func(io.Writer) error
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+		write = r.WriteJSON
+	case ".md":
+		write = r.WriteMarkdown
+	case ".html", ".htm":
+		write = r.WriteHTML
+	default:
+		return fmt.Errorf("unknown report format %q", ext)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return errgo.Notef(err, "cannot write report")
+	}
+	return f.Close()
+}
+
+func (impl ReportImpl) title() string {
+	if impl.Version == "" {
+		return string(impl.Name)
+	}
+	return fmt.Sprintf("%s (%s)", impl.Name, impl.Version)
+}
+
+// Result returns the result for the given implementation,
+// or nil if there is none.
+func (row *ReportRow) Result(impl Implementation) *Result {
+	result, ok := row.Results[impl]
+	if !ok {
+		return nil
+	}
+	return &result
+}
+
+// cell returns the text summarising the result
+// for the given implementation.
+func (row *ReportRow) cell(impl ReportImpl) string {
+	if impl.Unavailable != "" {
+		return "unavailable"
+	}
+	result, ok := row.Results[impl.Name]
+	if !ok {
+		return "-"
+	}
+	if result.Reason == "" {
+		return string(result.Outcome)
+	}
+	return fmt.Sprintf("%s: %s", result.Outcome, result.Reason)
+}
+
+var markdownEscaper = strings.NewReplacer(
+	"|", `\|`,
+	"\n", " ",
+	"*", `\*`,
+	"_", `\_`,
+	"`", "\\`",
+)
+
+func markdownEscape(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+var reportTemplate = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Macaroon compatibility report</title>
+<style>
+table { border-collapse: collapse; }
+th, td { border: 1px solid #999; padding: 0.2em 0.5em; vertical-align: top; }
+.pass { background: #cfc; }
+.fail { background: #fcc; }
+.divergent { background: #ffc; }
+.unexpected-pass { background: #fc9; }
+.unavailable { background: #ddd; }
+</style>
+</head>
+<body>
+<table>
+<tr><th>Check</th>{{range .Implementations}}<th>{{.Name}}{{if .Version}}<br>{{.Version}}{{end}}</th>{{end}}</tr>
+{{range $row := .Rows}}<tr><td>{{$row.Check}}</td>{{range $impl := $.Implementations}}{{if $impl.Unavailable}}<td class="unavailable" title="{{$impl.Unavailable}}">unavailable</td>{{else}}{{with $row.Result $impl.Name}}<td class="{{.Outcome}}">{{.Outcome}}{{if .Reason}}<br>{{.Reason}}{{end}}</td>{{else}}<td>-</td>{{end}}{{end}}{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
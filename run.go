@@ -0,0 +1,573 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon.v1"
+)
+
+// Runner runs compatibility checks against a set of
+// implementations and records the results in a report.
+type Runner struct {
+	// Impls holds the available implementations
+	// that the checks are run against.
+	Impls []Impl
+
+	// Unavailable holds the reason that each requested
+	// implementation that is not in Impls is unavailable.
+	Unavailable map[Implementation]error
+
+	// Versions holds the library version of each implementation
+	// in Impls. It is used to look up known divergences.
+	Versions map[Implementation]string
+
+	// Report holds the results of all the checks.
+	// If it is nil, the results are not recorded.
+	Report *Report
+
+	// Logf is used to log progress if it is non-nil.
+	Logf func(f string, a ...interface{})
+}
+
+// NewRunner returns a runner that runs checks against all the
+// available implementations in impls.
+func NewRunner(impls []Impl) (*Runner, error) {
+	r := &Runner{
+		Versions: make(map[Implementation]string),
+	}
+	r.Impls, r.Unavailable = AvailableImplementations(impls)
+	for _, impl := range r.Impls {
+		version, err := impl.Pkg.LibraryVersion()
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot get library version of %s", impl.Name)
+		}
+		r.Versions[impl.Name] = version
+	}
+	r.Report = NewReport(impls, r.Versions, r.Unavailable)
+	return r, nil
+}
+
+func (r *Runner) logf(f string, a ...interface{}) {
+	if r.Logf != nil {
+		r.Logf(f, a...)
+	}
+}
+
+func (r *Runner) add(check string, impl Implementation, result Result) {
+	if r.Report != nil {
+		r.Report.Add(check, impl, result)
+	}
+}
+
+// KnownDivergence returns the known divergence, if any, that causes
+// the version of the given implementation used by the runner to
+// exhibit any of the given behaviours.
+func (r *Runner) KnownDivergence(impl Implementation, behaviours []Behaviour) (KnownDivergence, bool) {
+	return LookupDivergence(impl, r.Versions[impl], behaviours)
+}
+
+// supporting returns a runner like r that uses only the
+// implementations that can create all the given macaroons.
+// Macaroons that must be created by the reference implementation
+// (see MakeMacaroon) are skipped by implementations known not to
+// support the version 2 JSON format, which are recorded as
+// divergent under the given check name.
+func (r *Runner) supporting(check string, mspecs ...MacaroonSpec) *Runner {
+	if !anyNeedsRef(mspecs...) {
+		return r
+	}
+	r1 := *r
+	r1.Impls = nil
+	for _, impl := range r.Impls {
+		if d, ok := r.KnownDivergence(impl.Name, []Behaviour{BehaviourNoJSONV2}); ok {
+			r.logf("skipping %s: %s", impl.Name, d.Reason)
+			r.add(check, impl.Name, Result{
+				Outcome: OutcomeDivergent,
+				Reason:  d.Reason,
+			})
+			continue
+		}
+		r1.Impls = append(r1.Impls, impl)
+	}
+	return &r1
+}
+
+// CheckConsistency checks that f returns the same result for all the
+// implementations and returns that result, recording the outcome for
+// each implementation in the report under the given check name.
+//
+// If expect is non-nil, every implementation must return that value;
+// otherwise the first implementation is used as the reference.
+// Implementations known to exhibit any of the given behaviours are
+// expected to produce a different result.
+//
+// An error is returned for each implementation that fails the check,
+// or that unexpectedly passes it.
+func (r *Runner) CheckConsistency(
+	check string,
+	behaviours []Behaviour,
+	expect interface{},
+	f func(Package) (interface{}, error),
+) (interface{}, []error) {
+	var impls, divergent []Impl
+	for _, impl := range r.Impls {
+		if _, ok := r.KnownDivergence(impl.Name, behaviours); ok {
+			divergent = append(divergent, impl)
+		} else {
+			impls = append(impls, impl)
+		}
+	}
+	var errs []error
+	fail := func(impl Implementation, reason string) {
+		errs = append(errs, fmt.Errorf("%s: %s %s", check, impl, reason))
+		r.add(check, impl, Result{
+			Outcome: OutcomeFail,
+			Reason:  reason,
+		})
+	}
+	gotVal := expect != nil
+	firstVal, firstRef := expect, "expected value"
+	var firstErr error
+	for i, impl := range impls {
+		r.logf("consistency check %d: %s", i, impl.Name)
+		val, err := f(impl.Pkg)
+		if !gotVal {
+			firstVal, firstErr, firstRef, gotVal = val, err, string(impl.Name), true
+			r.add(check, impl.Name, Result{Outcome: OutcomePass})
+			continue
+		}
+		switch {
+		case firstErr != nil && err == nil:
+			fail(impl.Name, fmt.Sprintf("succeeded without expected error %s; value %#v", firstErr, val))
+		case firstErr != nil:
+			r.add(check, impl.Name, Result{Outcome: OutcomePass})
+		case err != nil:
+			fail(impl.Name, fmt.Sprintf("failed unexpectedly with error %v", err))
+		case !reflect.DeepEqual(val, firstVal):
+			fail(impl.Name, fmt.Sprintf("is inconsistent with %s; got %#v want %#v", firstRef, val, firstVal))
+		default:
+			r.add(check, impl.Name, Result{Outcome: OutcomePass})
+		}
+	}
+	if !gotVal {
+		return nil, nil
+	}
+	for _, impl := range divergent {
+		d, _ := r.KnownDivergence(impl.Name, behaviours)
+		r.logf("known divergence check: %s", impl.Name)
+		val, err := f(impl.Pkg)
+		if (err != nil) == (firstErr != nil) && (err != nil || reflect.DeepEqual(val, firstVal)) {
+			errs = append(errs, unexpectedPassError(check, d))
+			r.add(check, impl.Name, Result{
+				Outcome: OutcomeUnexpectedPass,
+				Reason:  d.Reason,
+			})
+		} else {
+			r.add(check, impl.Name, Result{
+				Outcome: OutcomeDivergent,
+				Reason:  d.Reason,
+			})
+		}
+	}
+	return firstVal, errs
+}
+
+func unexpectedPassError(check string, d KnownDivergence) error {
+	return fmt.Errorf("%s: unexpectedly passing: %s no longer exhibits %s (%s)", check, d.Impl, d.Behaviour, d.Reason)
+}
+
+// RunCorpus runs all the test vectors in the given corpus for which
+// include returns true when passed the vector's description.
+// If include is nil, all vectors are run. It returns an error for
+// each failed check.
+func (r *Runner) RunCorpus(c *Corpus, include func(about string) bool) []error {
+	if include == nil {
+		include = func(string) bool { return true }
+	}
+	var errs []error
+	for _, v := range c.Signature {
+		if include(v.About) {
+			errs = append(errs, r.RunSignature(v)...)
+		}
+	}
+	for _, v := range c.Verify {
+		if include(v.About) {
+			errs = append(errs, r.RunVerify(v)...)
+		}
+	}
+	for _, v := range c.Serialization {
+		if include(v.About) {
+			errs = append(errs, r.RunSerialization(v)...)
+		}
+	}
+	return errs
+}
+
+// RunSignature checks that all the implementations produce
+// the same signature for the macaroon in the given vector.
+func (r *Runner) RunSignature(v SignatureVector) []error {
+	r = r.supporting("signature: "+v.About, v.Macaroon)
+	r.logf("signature test: %s", v.About)
+	var expect interface{}
+	if v.ExpectSignature != "" {
+		sig, err := hex.DecodeString(v.ExpectSignature)
+		if err != nil {
+			return []error{fmt.Errorf("signature: %s: bad expected signature: %v", v.About, err)}
+		}
+		expect = sig
+	}
+	_, errs := r.CheckConsistency("signature: "+v.About, v.Divergences, expect, func(pkg Package) (interface{}, error) {
+		m, err := MakeMacaroon(pkg, v.Macaroon)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		defer m.Free()
+		return m.Signature(), nil
+	})
+	return errs
+}
+
+// RunVerify checks that all the implementations produce the
+// expected verification results for the given vector.
+func (r *Runner) RunVerify(v VerifyVector) []error {
+	r = r.supporting("verify: "+v.About, v.Macaroons...)
+	r.logf("verify test: %s", v.About)
+	var errs []error
+	for _, impl := range r.Impls {
+		r.logf("implementation %s", impl.Name)
+		rootKey, macaroons, err := MakeMacaroons(impl.Pkg, v.Macaroons)
+		if err != nil {
+			for j := range v.Checks {
+				check := verifyCheckName(v, j)
+				errs = append(errs, fmt.Errorf("%s: %s: %v", check, impl.Name, err))
+				r.add(check, impl.Name, Result{
+					Outcome: OutcomeFail,
+					Reason:  err.Error(),
+				})
+			}
+			continue
+		}
+		for j, cond := range v.Checks {
+			r.logf("-- check %d: %s; %#v", j, impl.Name, cond.Checker())
+			err := macaroons[0].Verify(rootKey, cond.Checker(), macaroons[1:])
+			if err := r.addVerifyResult(verifyCheckName(v, j), impl.Name, cond, err); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		FreeAll(macaroons)
+	}
+	return errs
+}
+
+func verifyCheckName(v VerifyVector, i int) string {
+	return fmt.Sprintf("verify: %s (check %d)", v.About, i)
+}
+
+// RunConditions checks that all the implementations return the same
+// first party conditions from VerifyConditions for the macaroons in
+// the given vector, or all fail. The conditions are compared in
+// sorted order, as the order in which they are found differs between
+// implementations (see RunTrace).
+//
+// Implementations known to exhibit any of the behaviours in the
+// vector's checks are expected to differ.
+func (r *Runner) RunConditions(v VerifyVector) []error {
+	r = r.supporting("conditions: "+v.About, v.Macaroons...)
+	r.logf("conditions test: %s", v.About)
+	var behaviours []Behaviour
+	for _, check := range v.Checks {
+		behaviours = append(behaviours, check.Divergences...)
+	}
+	_, errs := r.CheckConsistency("conditions: "+v.About, behaviours, nil, func(pkg Package) (interface{}, error) {
+		rootKey, macaroons, err := MakeMacaroons(pkg, v.Macaroons)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		defer FreeAll(macaroons)
+		conds, err := macaroons[0].VerifyConditions(rootKey, macaroons[1:])
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		conds = append([]string{}, conds...)
+		sort.Strings(conds)
+		return conds, nil
+	})
+	return errs
+}
+
+// addVerifyResult records the result of verifying with the given
+// implementation, where verifyErr holds the error returned by Verify.
+// It returns an error if the result is not as expected.
+func (r *Runner) addVerifyResult(check string, impl Implementation, cond VerifyCheck, verifyErr error) error {
+	asExpected := (verifyErr == nil) == (cond.ExpectError == "")
+	if d, ok := r.KnownDivergence(impl, cond.Divergences); ok {
+		if asExpected {
+			r.add(check, impl, Result{
+				Outcome: OutcomeUnexpectedPass,
+				Reason:  d.Reason,
+			})
+			return unexpectedPassError(check, d)
+		}
+		r.add(check, impl, Result{
+			Outcome: OutcomeDivergent,
+			Reason:  d.Reason,
+		})
+		return nil
+	}
+	if asExpected {
+		r.add(check, impl, Result{Outcome: OutcomePass})
+		return nil
+	}
+	var reason string
+	if verifyErr != nil {
+		reason = fmt.Sprintf("unexpected error: %v", verifyErr)
+	} else {
+		reason = fmt.Sprintf("unexpected success (expected %s error %q)", cond.ExpectErrorCategory, cond.ExpectError)
+	}
+	r.add(check, impl, Result{
+		Outcome: OutcomeFail,
+		Reason:  reason,
+	})
+	return fmt.Errorf("%s: %s: %s", check, impl, reason)
+}
+
+// RunSerialization checks that the macaroon in the given vector,
+// when serialized to JSON by each implementation, can be deserialized
+// by all the other implementations, and that they all serialize it
+// back to an equivalent form.
+func (r *Runner) RunSerialization(v SerializationVector) []error {
+	r = r.supporting("serialization: "+v.About, v.Macaroon)
+	r.logf("serialization test: %s", v.About)
+	noJSONV1 := []Behaviour{BehaviourNoJSONV1}
+	var errs []error
+	for _, impl := range r.Impls {
+		if _, ok := r.KnownDivergence(impl.Name, noJSONV1); ok {
+			continue
+		}
+		check := fmt.Sprintf("serialization: %s (from %s)", v.About, impl.Name)
+		m, err := MakeMacaroon(impl.Pkg, v.Macaroon)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", check, err))
+			continue
+		}
+		data, err := m.MarshalJSON()
+		m.Free()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: cannot marshal: %v", check, err))
+			continue
+		}
+		r.logf("macaroon data from %s:\n%s", impl.Name, data)
+		// Check the marshaled form can be unmarshaled by all the other packages.
+		// and that it can be marshaled back and eventually produces the
+		// same representation for all packages.
+		_, cerrs := r.CheckConsistency(check, noJSONV1, nil, func(pkg Package) (interface{}, error) {
+			m, err := pkg.UnmarshalJSON(data)
+			if err != nil {
+				return nil, fmt.Errorf("cannot unmarshal %s: %v", data, err)
+			}
+			defer m.Free()
+			data, err := m.MarshalJSON()
+			if err != nil {
+				return nil, fmt.Errorf("cannot marshal: %v", err)
+			}
+			return canonicalJSON(data)
+		})
+		errs = append(errs, cerrs...)
+	}
+	return errs
+}
+
+// RunDifferential checks that all the implementations agree on
+// the signature and serialized form of each macaroon in the given
+// vector, and on the outcome of each of its checks. The expected
+// results in the checks are ignored, which makes it suitable for
+// vectors made by GenerateVerifyVector.
+func (r *Runner) RunDifferential(v VerifyVector) []error {
+	r = r.supporting("differential: "+v.About, v.Macaroons...)
+	r.logf("differential test: %s", v.About)
+	var errs []error
+	for i, mspec := range v.Macaroons {
+		var behaviours []Behaviour
+		if hasThirdPartyCaveat(mspec) {
+			behaviours = append(behaviours, BehaviourRandomNonce)
+		}
+		_, cerrs := r.CheckConsistency(fmt.Sprintf("%s: signature of macaroon %d", v.About, i), behaviours, nil, func(pkg Package) (interface{}, error) {
+			m, err := MakeMacaroon(pkg, mspec)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			defer m.Free()
+			return m.Signature(), nil
+		})
+		errs = append(errs, cerrs...)
+		behaviours = append(behaviours, BehaviourNoJSONV1)
+		_, cerrs = r.CheckConsistency(fmt.Sprintf("%s: serialization of macaroon %d", v.About, i), behaviours, nil, func(pkg Package) (interface{}, error) {
+			m, err := MakeMacaroon(pkg, mspec)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			defer m.Free()
+			data, err := m.MarshalJSON()
+			if err != nil {
+				return nil, fmt.Errorf("cannot marshal: %v", err)
+			}
+			return canonicalJSON(data)
+		})
+		errs = append(errs, cerrs...)
+	}
+	for j, check := range v.Checks {
+		_, cerrs := r.CheckConsistency(verifyCheckName(v, j), nil, nil, func(pkg Package) (interface{}, error) {
+			rootKey, macaroons, err := MakeMacaroons(pkg, v.Macaroons)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			defer FreeAll(macaroons)
+			// Only the success of the verification is compared
+			// because the error messages differ between
+			// implementations.
+			err = macaroons[0].Verify(rootKey, check.Checker(), macaroons[1:])
+			return err == nil, nil
+		})
+		errs = append(errs, cerrs...)
+	}
+	return errs
+}
+
+func hasThirdPartyCaveat(mspec MacaroonSpec) bool {
+	for _, cav := range mspec.Caveats {
+		if cav.Location != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Format names a macaroon serialization format.
+type Format string
+
+const (
+	FormatJSON   Format = "json"
+	FormatBinary Format = "binary"
+)
+
+// unsupported returns the behaviours exhibited by
+// implementations that do not support the format.
+func (f Format) unsupported() []Behaviour {
+	switch f {
+	case FormatJSON:
+		return []Behaviour{BehaviourNoJSONV1}
+	case FormatBinary:
+		return []Behaviour{BehaviourNoBinary}
+	}
+	panic(fmt.Errorf("unknown format %q", f))
+}
+
+// RunUnmarshal unmarshals the given data in the given format with
+// all the implementations that support the format and checks that
+// they agree on whether it is valid and, if so, on the signature of the
+// resulting macaroon. An error is also returned for each implementation
+// that panics or whose interpreter crashes or hangs. The data
+// need not be well formed, which makes it suitable for fuzzing.
+func (r *Runner) RunUnmarshal(about string, format Format, data []byte) []error {
+	check := fmt.Sprintf("unmarshal %s: %s", format, about)
+	r.logf("%s: %q", check, data)
+	var errs []error
+	var impls []Implementation
+	outcomes := make(map[Implementation]string)
+	for _, impl := range r.Impls {
+		if _, ok := r.KnownDivergence(impl.Name, format.unsupported()); ok {
+			continue
+		}
+		outcome, err := unmarshalOutcome(impl.Pkg, format, data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s %v", check, impl.Name, err))
+			r.add(check, impl.Name, Result{
+				Outcome: OutcomeFail,
+				Reason:  err.Error(),
+			})
+			continue
+		}
+		impls = append(impls, impl.Name)
+		outcomes[impl.Name] = outcome
+	}
+	for _, impl := range impls {
+		if outcome, first := outcomes[impl], outcomes[impls[0]]; outcome != first {
+			reason := fmt.Sprintf("%s but %s %s", outcome, impls[0], first)
+			errs = append(errs, fmt.Errorf("%s: %s %s", check, impl, reason))
+			r.add(check, impl, Result{
+				Outcome: OutcomeFail,
+				Reason:  reason,
+			})
+		} else {
+			r.add(check, impl, Result{Outcome: OutcomePass})
+		}
+	}
+	return errs
+}
+
+// unmarshalOutcome unmarshals data with the given package and
+// returns a description of the outcome. It returns an error only
+// if the implementation panics or its interpreter fails.
+func unmarshalOutcome(pkg Package, format Format, data []byte) (outcome string, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("panicked: %v", e)
+		}
+	}()
+	m, err := unmarshal(pkg, data, format)
+	if m != nil {
+		defer m.Free()
+	}
+	if err != nil {
+		if cause := errgo.Cause(err); cause == ErrInterpCrashed || cause == ErrInterpTimeout {
+			return "", err
+		}
+		return "rejected", nil
+	}
+	return fmt.Sprintf("accepted with signature %x", m.Signature()), nil
+}
+
+// canonicalJSON returns the given JSON-serialized macaroon
+// as serialized by the reference implementation.
+func canonicalJSON(data []byte) (string, error) {
+	var m *macaroon.Macaroon
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", fmt.Errorf("cannot unmarshal %s: %v", data, err)
+	}
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal: %v", err)
+	}
+	return string(data), nil
+}
+
+// UseDeterministicNonces replaces crypto/rand.Reader with a reader
+// that returns only zero bytes, so that the nonces used when adding
+// third party caveats, and hence the signatures of the resulting
+// macaroons, are reproducible. It returns a function that restores
+// the original reader.
+func UseDeterministicNonces() (restore func()) {
+	orig := rand.Reader
+	rand.Reader = zeroReader{}
+	return func() {
+		rand.Reader = orig
+	}
+}
+
+type zeroReader struct{}
+
+func (r zeroReader) Read(buf []byte) (int, error) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	return len(buf), nil
+}
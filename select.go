@@ -0,0 +1,83 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SelectImplementations returns the members of Implementations
+// with names in include but not in exclude, in the same order as
+// Implementations. If include is empty, all implementations
+// not in exclude are returned.
+func SelectImplementations(include, exclude []string) ([]Impl, error) {
+	included, err := implSet(include)
+	if err != nil {
+		return nil, err
+	}
+	excluded, err := implSet(exclude)
+	if err != nil {
+		return nil, err
+	}
+	var impls []Impl
+	for _, impl := range Implementations {
+		if len(include) > 0 && !included[impl.Name] {
+			continue
+		}
+		if excluded[impl.Name] {
+			continue
+		}
+		impls = append(impls, impl)
+	}
+	return impls, nil
+}
+
+// ParseImplementations parses a comma-separated list
+// of implementation names as accepted by SelectImplementations.
+// Empty elements are ignored.
+func ParseImplementations(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func implSet(names []string) (map[Implementation]bool, error) {
+	set := make(map[Implementation]bool)
+	for _, name := range names {
+		if implByName(Implementation(name)) == nil {
+			return nil, fmt.Errorf("unknown implementation %q", name)
+		}
+		set[Implementation(name)] = true
+	}
+	return set, nil
+}
+
+// AvailableImplementations returns the members of impls
+// that are available for use. The reason that each other
+// implementation is unavailable is returned in unavailable.
+func AvailableImplementations(impls []Impl) (available []Impl, unavailable map[Implementation]error) {
+	unavailable = make(map[Implementation]error)
+	for _, impl := range impls {
+		if err := impl.Pkg.Available(); err != nil {
+			unavailable[impl.Name] = err
+			continue
+		}
+		available = append(available, impl)
+	}
+	return available, unavailable
+}
+
+func implByName(name Implementation) *Impl {
+	for i := range Implementations {
+		if Implementations[i].Name == name {
+			return &Implementations[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// SessionMode specifies what happens to the expressions
+// sent to the interpreters that run the non-Go implementations.
+type SessionMode int
+
+const (
+	// SessionLive runs the interpreters without recording anything.
+	SessionLive SessionMode = iota
+
+	// SessionRecord runs the interpreters and saves every
+	// expression and its response to a session file.
+	SessionRecord
+
+	// SessionReplay does not run any interpreters. Instead
+	// responses are served from previously recorded session
+	// files. An expression that differs from the one that was
+	// recorded causes an error.
+	SessionReplay
+)
+
+var (
+	sessionMode SessionMode
+	sessionDir  string
+
+	// recorders holds all the session recorders
+	// that have not yet been closed.
+	recorders []*sessionRecorder
+)
+
+// SetSessionMode sets the session mode for all interpreters.
+// Each interpreter records to or replays from its own file
+// inside dir, named after the interpreter.
+//
+// It only affects interpreters that have not yet been started.
+// Note that a replay will only succeed when exactly the same
+// sequence of operations is performed as when the session was
+// recorded, so the same set of tests should be run in both cases.
+func SetSessionMode(mode SessionMode, dir string) {
+	sessionMode = mode
+	sessionDir = dir
+}
+
+// sessionPath returns the path of the session file
+// used by the interpreter with the given name.
+func sessionPath(name string) string {
+	return filepath.Join(sessionDir, name+".session")
+}
+
+// sessionEntry holds one recorded round trip
+// to an interpreter.
+type sessionEntry struct {
+	Expr     string `json:"expr"`
+	Response string `json:"response"`
+}
+
+// sessionRecorder saves round trips to a session file.
+type sessionRecorder struct {
+	path string
+
+	// f and enc are nil when the session file is closed.
+	f   *os.File
+	enc *json.Encoder
+}
+
+func newSessionRecorder(name string) (*sessionRecorder, error) {
+	if err := os.MkdirAll(sessionDir, 0777); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	r := &sessionRecorder{
+		path: sessionPath(name),
+	}
+	if err := r.open(os.O_TRUNC); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return r, nil
+}
+
+// open opens the session file for writing, with the given
+// flag in addition to os.O_WRONLY|os.O_CREATE.
+func (r *sessionRecorder) open(flag int) error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|flag, 0666)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	r.f = f
+	r.enc = json.NewEncoder(f)
+	recorders = append(recorders, r)
+	return nil
+}
+
+// Close closes the session file. If anything more is
+// recorded, the file is opened again and appended to.
+func (r *sessionRecorder) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	for i, r1 := range recorders {
+		if r1 == r {
+			recorders = append(recorders[:i], recorders[i+1:]...)
+			break
+		}
+	}
+	f := r.f
+	r.f, r.enc = nil, nil
+	if err := f.Close(); err != nil {
+		return errgo.Notef(err, "cannot close session")
+	}
+	return nil
+}
+
+// CloseSessions closes all the session files that are being
+// recorded. It should be called when recording is complete.
+// If an interpreter is used afterwards, its session file is
+// opened again and the new round trips are appended to it.
+func CloseSessions() error {
+	var firstErr error
+	for len(recorders) > 0 {
+		if err := recorders[0].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (r *sessionRecorder) record(expr string, response []byte) error {
+	if r.f == nil {
+		if err := r.open(os.O_APPEND); err != nil {
+			return errgo.Notef(err, "cannot reopen session")
+		}
+	}
+	if err := r.enc.Encode(sessionEntry{
+		Expr:     expr,
+		Response: string(response),
+	}); err != nil {
+		return errgo.Notef(err, "cannot record session")
+	}
+	return nil
+}
+
+// sessionPlayer serves responses from a session file.
+type sessionPlayer struct {
+	path    string
+	entries []sessionEntry
+}
+
+func newSessionPlayer(name string) (*sessionPlayer, error) {
+	path := sessionPath(name)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errgo.Mask(err, os.IsNotExist)
+	}
+	defer f.Close()
+	p := &sessionPlayer{
+		path: path,
+	}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var e sessionEntry
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errgo.Notef(err, "cannot read session from %q", path)
+		}
+		p.entries = append(p.entries, e)
+	}
+	return p, nil
+}
+
+// next returns the recorded response to expr, which must
+// be the next expression in the session.
+func (p *sessionPlayer) next(expr string) ([]byte, error) {
+	if len(p.entries) == 0 {
+		return nil, fmt.Errorf("session %q exhausted at %q", p.path, expr)
+	}
+	e := p.entries[0]
+	if e.Expr != expr {
+		return nil, fmt.Errorf("session %q: unexpected expression %q (recorded %q)", p.path, expr, e.Expr)
+	}
+	p.entries = p.entries[1:]
+	return []byte(e.Response), nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat_test
+
+import (
+	"os/exec"
+
+	gc "gopkg.in/check.v1"
+
+	mcompat "github.com/go-macaroon/macarooncompat"
+)
+
+type sessionSuite struct {
+	origMode mcompat.SessionMode
+	origDir  string
+}
+
+var _ = gc.Suite(&sessionSuite{})
+
+func (s *sessionSuite) SetUpTest(c *gc.C) {
+	s.origMode, s.origDir = mcompat.CurrentSessionMode()
+}
+
+func (s *sessionSuite) TearDownTest(c *gc.C) {
+	mcompat.SetSessionMode(s.origMode, s.origDir)
+}
+
+func (*sessionSuite) TestRecordReplay(c *gc.C) {
+	dir := c.MkDir()
+	mcompat.SetSessionMode(mcompat.SessionRecord, dir)
+	r, err := mcompat.NewSessionRecorder("test")
+	c.Assert(err, gc.IsNil)
+	err = r.Record("x = 1", []byte(`{"result": null}`))
+	c.Assert(err, gc.IsNil)
+	err = r.Record("result = x", []byte(`{"result": 1}`))
+	c.Assert(err, gc.IsNil)
+	err = r.Close()
+	c.Assert(err, gc.IsNil)
+
+	mcompat.SetSessionMode(mcompat.SessionReplay, dir)
+	p, err := mcompat.NewSessionPlayer("test")
+	c.Assert(err, gc.IsNil)
+	resp, err := p.Next("x = 1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(resp), gc.Equals, `{"result": null}`)
+	resp, err = p.Next("result = x")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(resp), gc.Equals, `{"result": 1}`)
+	_, err = p.Next("result = x")
+	c.Assert(err, gc.ErrorMatches, `session ".*test.session" exhausted at "result = x"`)
+}
+
+func (*sessionSuite) TestReplayUnexpectedExpression(c *gc.C) {
+	dir := c.MkDir()
+	mcompat.SetSessionMode(mcompat.SessionRecord, dir)
+	r, err := mcompat.NewSessionRecorder("test")
+	c.Assert(err, gc.IsNil)
+	err = r.Record("x = 1", []byte(`{"result": null}`))
+	c.Assert(err, gc.IsNil)
+	c.Assert(mcompat.CloseSessions(), gc.IsNil)
+
+	mcompat.SetSessionMode(mcompat.SessionReplay, dir)
+	p, err := mcompat.NewSessionPlayer("test")
+	c.Assert(err, gc.IsNil)
+	_, err = p.Next("x = 2")
+	c.Assert(err, gc.ErrorMatches, `session ".*test.session": unexpected expression "x = 2" \(recorded "x = 1"\)`)
+}
+
+func (*sessionSuite) TestReplayMissingSession(c *gc.C) {
+	mcompat.SetSessionMode(mcompat.SessionReplay, c.MkDir())
+	_, err := mcompat.NewSessionPlayer("test")
+	c.Assert(err, gc.ErrorMatches, `open .*test.session: no such file or directory`)
+}
+
+func (*sessionSuite) TestRecordAfterCloseSessions(c *gc.C) {
+	dir := c.MkDir()
+	mcompat.SetSessionMode(mcompat.SessionRecord, dir)
+	r, err := mcompat.NewSessionRecorder("test")
+	c.Assert(err, gc.IsNil)
+	err = r.Record("x = 1", []byte(`{"result": null}`))
+	c.Assert(err, gc.IsNil)
+	c.Assert(mcompat.CloseSessions(), gc.IsNil)
+	err = r.Record("result = x", []byte(`{"result": 1}`))
+	c.Assert(err, gc.IsNil)
+	c.Assert(mcompat.CloseSessions(), gc.IsNil)
+
+	mcompat.SetSessionMode(mcompat.SessionReplay, dir)
+	p, err := mcompat.NewSessionPlayer("test")
+	c.Assert(err, gc.IsNil)
+	_, err = p.Next("x = 1")
+	c.Assert(err, gc.IsNil)
+	resp, err := p.Next("result = x")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(resp), gc.Equals, `{"result": 1}`)
+}
+
+func (*sessionSuite) TestRecordReplayInterpreter(c *gc.C) {
+	if _, err := exec.LookPath("node"); err != nil {
+		c.Skip("node not installed")
+	}
+	exprs := []string{"1+1", `"a" + "b"`, "[1, 2].length"}
+	eval := func(i mcompat.RawInterp) []interface{} {
+		var results []interface{}
+		for _, expr := range exprs {
+			var r interface{}
+			err := i.Eval(expr, &r)
+			c.Assert(err, gc.IsNil)
+			results = append(results, r)
+		}
+		return results
+	}
+	dir := c.MkDir()
+	mcompat.SetSessionMode(mcompat.SessionRecord, dir)
+	i := mcompat.NewRawJSInterp()
+	recorded := eval(i)
+	i.Close()
+	c.Assert(recorded, gc.DeepEquals, []interface{}{2.0, "ab", 2.0})
+	// The interpreter can still be used after the
+	// session files have been closed.
+	c.Assert(mcompat.CloseSessions(), gc.IsNil)
+	recorded = append(recorded, eval(i)...)
+	i.Close()
+	c.Assert(mcompat.CloseSessions(), gc.IsNil)
+
+	// No interpreter process is run when replaying.
+	mcompat.SetSessionMode(mcompat.SessionReplay, dir)
+	i = mcompat.NewRawJSInterp()
+	replayed := eval(i)
+	replayed = append(replayed, eval(i)...)
+	c.Assert(replayed, gc.DeepEquals, recorded)
+	c.Assert(i.Running(), gc.Equals, false)
+	var r interface{}
+	err := i.Eval("1+1", &r)
+	c.Assert(err, gc.ErrorMatches, `.*session ".*" exhausted at .*`)
+}
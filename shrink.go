@@ -0,0 +1,145 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Shrink returns a minimal version of v on which the two given
+// implementations still disagree, as reported by RunDifferential.
+// It returns an error if either implementation is not available
+// to the runner or if they do not disagree on v.
+func (r *Runner) Shrink(v VerifyVector, impl0, impl1 Implementation) (VerifyVector, error) {
+	pair := &Runner{
+		Versions: r.Versions,
+		Logf:     r.Logf,
+	}
+	for _, name := range []Implementation{impl0, impl1} {
+		found := false
+		for _, impl := range r.Impls {
+			if impl.Name == name {
+				pair.Impls = append(pair.Impls, impl)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return VerifyVector{}, fmt.Errorf("implementation %q not available", name)
+		}
+	}
+	fails := func(v VerifyVector) bool {
+		return len(pair.RunDifferential(v)) > 0
+	}
+	if !fails(v) {
+		return VerifyVector{}, fmt.Errorf("%s and %s do not disagree on %q", impl0, impl1, v.About)
+	}
+	return ShrinkVerifyVector(v, fails), nil
+}
+
+// ShrinkVerifyVector repeatedly removes discharge macaroons,
+// checks, caveats and conditions from v for as long as fails
+// continues to return true, and returns the result. The fails
+// function must return true for v itself.
+//
+// The primary macaroon and at least one check are always kept.
+func ShrinkVerifyVector(v VerifyVector, fails func(VerifyVector) bool) VerifyVector {
+	for {
+		shrunk := false
+		for _, cand := range shrinkCandidates(v) {
+			if fails(cand) {
+				v, shrunk = cand, true
+				break
+			}
+		}
+		if !shrunk {
+			return v
+		}
+	}
+}
+
+// shrinkCandidates returns all the vectors that can be made
+// by removing a single element from v.
+func shrinkCandidates(v VerifyVector) []VerifyVector {
+	var cands []VerifyVector
+	for i := 1; i < len(v.Macaroons); i++ {
+		cand := copyVerifyVector(v)
+		cand.Macaroons = append(cand.Macaroons[:i], cand.Macaroons[i+1:]...)
+		cands = append(cands, cand)
+	}
+	if len(v.Checks) > 1 {
+		for i := range v.Checks {
+			cand := copyVerifyVector(v)
+			cand.Checks = append(cand.Checks[:i], cand.Checks[i+1:]...)
+			cands = append(cands, cand)
+		}
+	}
+	for i, m := range v.Macaroons {
+		for j, cav := range m.Caveats {
+			cand := copyVerifyVector(v)
+			caveats := cand.Macaroons[i].Caveats
+			cand.Macaroons[i].Caveats = append(caveats[:j], caveats[j+1:]...)
+			if cav.Location != "" {
+				// Remove the discharge along with the
+				// third party caveat too.
+				cand.Macaroons = removeDischarge(cand.Macaroons, cav.Condition)
+			}
+			cands = append(cands, cand)
+		}
+	}
+	for i, check := range v.Checks {
+		conds := make([]string, 0, len(check.Conditions))
+		for cond := range check.Conditions {
+			conds = append(conds, cond)
+		}
+		sort.Strings(conds)
+		for _, cond := range conds {
+			cand := copyVerifyVector(v)
+			delete(cand.Checks[i].Conditions, cond)
+			cands = append(cands, cand)
+		}
+		for j := range check.Predicates {
+			cand := copyVerifyVector(v)
+			preds := cand.Checks[i].Predicates
+			cand.Checks[i].Predicates = append(preds[:j], preds[j+1:]...)
+			cands = append(cands, cand)
+		}
+	}
+	return cands
+}
+
+// removeDischarge returns ms without the first discharge
+// macaroon with the given id.
+func removeDischarge(ms []MacaroonSpec, id string) []MacaroonSpec {
+	for i := 1; i < len(ms); i++ {
+		if ms[i].Id == id {
+			return append(ms[:i], ms[i+1:]...)
+		}
+	}
+	return ms
+}
+
+// copyVerifyVector returns a copy of v that
+// shares no mutable data with it.
+func copyVerifyVector(v VerifyVector) VerifyVector {
+	v1 := v
+	v1.Macaroons = make([]MacaroonSpec, len(v.Macaroons))
+	for i, m := range v.Macaroons {
+		m.Caveats = append([]CaveatSpec(nil), m.Caveats...)
+		v1.Macaroons[i] = m
+	}
+	v1.Checks = make([]VerifyCheck, len(v.Checks))
+	for i, check := range v.Checks {
+		conds := make(Conditions)
+		for cond, ok := range check.Conditions {
+			conds[cond] = ok
+		}
+		check.Conditions = conds
+		check.Predicates = append(Predicates(nil), check.Predicates...)
+		check.Divergences = append([]Behaviour(nil), check.Divergences...)
+		v1.Checks[i] = check
+	}
+	return v1
+}
@@ -0,0 +1,217 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat_test
+
+import (
+	"bytes"
+
+	gc "gopkg.in/check.v1"
+
+	mcompat "github.com/go-macaroon/macarooncompat"
+)
+
+type shrinkSuite struct{}
+
+var _ = gc.Suite(&shrinkSuite{})
+
+func (*shrinkSuite) TestShrinkVerifyVector(c *gc.C) {
+	v := mcompat.VerifyVector{
+		About: "shrink",
+		Macaroons: []mcompat.MacaroonSpec{{
+			RootKey: "root key",
+			Id:      "primary",
+			Caveats: []mcompat.CaveatSpec{{
+				Condition: "a",
+			}, {
+				Condition: "tp1",
+				Location:  "tp1-loc",
+				RootKey:   "tp1 key",
+			}, {
+				Condition: "b",
+			}},
+		}, {
+			RootKey:  "tp1 key",
+			Id:       "tp1",
+			Location: "tp1-loc",
+			Caveats: []mcompat.CaveatSpec{{
+				Condition: "c",
+			}, {
+				Condition: "bad",
+			}},
+		}},
+		Checks: []mcompat.VerifyCheck{{
+			Conditions: map[string]bool{"a": true, "b": true},
+		}, {
+			Conditions: map[string]bool{"a": true, "c": true},
+		}},
+	}
+	// Pretend that the failure is caused by a caveat with the
+	// condition "bad" in a discharge macaroon when "c" is
+	// satisfied by any check.
+	fails := func(v mcompat.VerifyVector) bool {
+		satisfied := false
+		for _, check := range v.Checks {
+			satisfied = satisfied || check.Conditions["c"]
+		}
+		if !satisfied {
+			return false
+		}
+		for _, m := range v.Macaroons[1:] {
+			for _, cav := range m.Caveats {
+				if cav.Condition == "bad" {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	c.Assert(fails(v), gc.Equals, true)
+	shrunk := mcompat.ShrinkVerifyVector(v, fails)
+	c.Assert(shrunk, gc.DeepEquals, mcompat.VerifyVector{
+		About: "shrink",
+		Macaroons: []mcompat.MacaroonSpec{{
+			RootKey: "root key",
+			Id:      "primary",
+			Caveats: []mcompat.CaveatSpec{{
+				Condition: "tp1",
+				Location:  "tp1-loc",
+				RootKey:   "tp1 key",
+			}},
+		}, {
+			RootKey:  "tp1 key",
+			Id:       "tp1",
+			Location: "tp1-loc",
+			Caveats: []mcompat.CaveatSpec{{
+				Condition: "bad",
+			}},
+		}},
+		Checks: []mcompat.VerifyCheck{{
+			Conditions: map[string]bool{"c": true},
+		}},
+	})
+	// Check that the original vector has not been changed.
+	c.Assert(v.Macaroons[0].Caveats, gc.HasLen, 3)
+	c.Assert(v.Checks, gc.HasLen, 2)
+}
+
+// badSigPackage wraps a package so that macaroons with a first
+// party caveat with the condition "bad" have the wrong signature.
+type badSigPackage struct {
+	mcompat.Package
+}
+
+func (p badSigPackage) New(rootKey []byte, id, loc string) (mcompat.Macaroon, error) {
+	m, err := p.Package.New(rootKey, id, loc)
+	if err != nil {
+		return nil, err
+	}
+	return badSigMacaroon{Macaroon: m}, nil
+}
+
+type badSigMacaroon struct {
+	mcompat.Macaroon
+	bad bool
+}
+
+func (m badSigMacaroon) WithFirstPartyCaveat(cond string) (mcompat.Macaroon, error) {
+	m1, err := m.Macaroon.WithFirstPartyCaveat(cond)
+	if err != nil {
+		return nil, err
+	}
+	return badSigMacaroon{
+		Macaroon: m1,
+		bad:      m.bad || cond == "bad",
+	}, nil
+}
+
+func (m badSigMacaroon) Signature() []byte {
+	sig := m.Macaroon.Signature()
+	if m.bad {
+		sig = append([]byte(nil), sig...)
+		sig[0] ^= 1
+	}
+	return sig
+}
+
+func (*shrinkSuite) TestShrink(c *gc.C) {
+	impl, ok := testImpl(c, mcompat.ImplGoV2)
+	if !ok {
+		c.Skip("gov2 implementation not selected")
+	}
+	r := &mcompat.Runner{
+		Impls: []mcompat.Impl{impl, {
+			Name: "badsig",
+			Pkg:  badSigPackage{impl.Pkg},
+		}},
+	}
+	v := mcompat.VerifyVector{
+		About: "shrink",
+		Macaroons: []mcompat.MacaroonSpec{{
+			RootKey: "root key",
+			Id:      "primary",
+			Caveats: []mcompat.CaveatSpec{{
+				Condition: "a",
+			}, {
+				Condition: "bad",
+			}, {
+				Condition: "b",
+			}},
+		}},
+		Checks: []mcompat.VerifyCheck{{
+			Conditions: map[string]bool{"a": true, "b": true, "bad": true},
+		}, {
+			Conditions: map[string]bool{"a": true},
+		}},
+	}
+	shrunk, err := r.Shrink(v, mcompat.ImplGoV2, "badsig")
+	c.Assert(err, gc.IsNil)
+	c.Assert(shrunk.Macaroons, gc.DeepEquals, []mcompat.MacaroonSpec{{
+		RootKey: "root key",
+		Id:      "primary",
+		Caveats: []mcompat.CaveatSpec{{
+			Condition: "bad",
+		}},
+	}})
+	c.Assert(shrunk.Checks, gc.HasLen, 1)
+	c.Assert(shrunk.Checks[0].Conditions, gc.HasLen, 0)
+
+	// The shrunk vector still shows the disagreement.
+	m, err := mcompat.MakeMacaroon(badSigPackage{impl.Pkg}, shrunk.Macaroons[0])
+	c.Assert(err, gc.IsNil)
+	defer m.Free()
+	m1, err := mcompat.MakeMacaroon(impl.Pkg, shrunk.Macaroons[0])
+	c.Assert(err, gc.IsNil)
+	defer m1.Free()
+	c.Assert(bytes.Equal(m.Signature(), m1.Signature()), gc.Equals, false)
+}
+
+func (*shrinkSuite) TestShrinkErrors(c *gc.C) {
+	impl, ok := testImpl(c, mcompat.ImplGoV2)
+	if !ok {
+		c.Skip("gov2 implementation not selected")
+	}
+	r := &mcompat.Runner{
+		Impls: []mcompat.Impl{impl, {
+			Name: "badsig",
+			Pkg:  badSigPackage{impl.Pkg},
+		}},
+	}
+	v := mcompat.VerifyVector{
+		About: "no disagreement",
+		Macaroons: []mcompat.MacaroonSpec{{
+			RootKey: "root key",
+			Id:      "primary",
+			Caveats: []mcompat.CaveatSpec{{
+				Condition: "a",
+			}},
+		}},
+		Checks: []mcompat.VerifyCheck{{
+			Conditions: map[string]bool{"a": true},
+		}},
+	}
+	_, err := r.Shrink(v, mcompat.ImplGoV2, "badsig")
+	c.Assert(err, gc.ErrorMatches, `gov2 and badsig do not disagree on "no disagreement"`)
+	_, err = r.Shrink(v, mcompat.ImplGoV2, "nonexistent")
+	c.Assert(err, gc.ErrorMatches, `implementation "nonexistent" not available`)
+}
@@ -0,0 +1,231 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"encoding/json"
+	"fmt"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// marshalJSONSlice implements Package.MarshalSlice in the JSON
+// format for implementations with no native support for slices
+// by marshaling each macaroon in turn.
+func marshalJSONSlice(ms []Macaroon) ([]byte, error) {
+	s := make([]json.RawMessage, len(ms))
+	for i, m := range ms {
+		data, err := m.MarshalJSON()
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot marshal macaroon %d", i)
+		}
+		s[i] = data
+	}
+	return json.Marshal(s)
+}
+
+// unmarshalJSONSlice implements Package.UnmarshalSlice in the
+// JSON format for implementations with no native support for
+// slices by unmarshaling each macaroon in turn.
+func unmarshalJSONSlice(pkg Package, data []byte) ([]Macaroon, error) {
+	var s []json.RawMessage
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ms := make([]Macaroon, 0, len(s))
+	for i, data := range s {
+		m, err := pkg.UnmarshalJSON(data)
+		if err != nil {
+			if m != nil {
+				m.Free()
+			}
+			FreeAll(ms)
+			return nil, errgo.Notef(err, "cannot unmarshal macaroon %d", i)
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// sliceOrigin describes a way of creating the macaroons
+// that are marshaled by RunSlice.
+type sliceOrigin struct {
+	// name describes the macaroons in check names. It is empty
+	// for macaroons created in the implementation's own way.
+	name string
+
+	// makeMacaroons creates the macaroons.
+	makeMacaroons func(Package, []MacaroonSpec) ([]byte, []Macaroon, error)
+
+	// unsupported holds the behaviours that prevent an
+	// implementation from creating the macaroons.
+	unsupported []Behaviour
+}
+
+// sliceOrigins holds the ways that RunSlice creates macaroons.
+// Implementations such as macaroon.v2 create version 1 macaroons
+// by default, so the version 2 macaroons created by the reference
+// implementation are tested too.
+var sliceOrigins = []sliceOrigin{{
+	makeMacaroons: MakeMacaroons,
+}, {
+	name:          "version 2",
+	makeMacaroons: makeRefMacaroons,
+	unsupported:   []Behaviour{BehaviourNoJSONV2},
+}}
+
+// RunSlice creates the macaroons in the given vector with each
+// implementation, binding the discharges to the primary, and
+// marshals them as a single slice in the given format. It checks
+// that every implementation can unmarshal each slice and verify
+// the primary macaroon with the discharges in it, using the checker
+// returned by VerifyVector.SuccessChecker. This is done both for the
+// macaroons as each implementation creates them and for version 2
+// macaroons.
+//
+// An implementation that cannot write the format or cannot read
+// the version of the data in a slice is recorded as divergent
+// for that slice.
+func (r *Runner) RunSlice(v VerifyVector, format Format) []error {
+	r = r.supporting(fmt.Sprintf("slice %s: %s", format, v.About), v.Macaroons...)
+	checker, ok := v.SuccessChecker()
+	if !ok {
+		return nil
+	}
+	r.logf("slice %s test: %s", format, v.About)
+	origins := sliceOrigins
+	if anyNeedsRef(v.Macaroons...) {
+		// The macaroons are always created by the
+		// reference implementation.
+		origins = origins[:1]
+	}
+	var errs []error
+	for _, origin := range origins {
+		errs = append(errs, r.runSlice(v, format, checker, origin)...)
+	}
+	return errs
+}
+
+func (r *Runner) runSlice(v VerifyVector, format Format, checker Checker, origin sliceOrigin) []error {
+	about := fmt.Sprintf("slice %s: %s", format, v.About)
+	if origin.name != "" {
+		about = fmt.Sprintf("slice %s, %s: %s", format, origin.name, v.About)
+	}
+	unwritable := origin.unsupported
+	if format == FormatBinary {
+		unwritable = append(unwritable, BehaviourNoBinary)
+	}
+	var errs []error
+	for _, from := range r.Impls {
+		check := fmt.Sprintf("%s (marshaled by %s)", about, from.Name)
+		if d, ok := r.KnownDivergence(from.Name, unwritable); ok {
+			r.add(check, from.Name, Result{
+				Outcome: OutcomeDivergent,
+				Reason:  d.Reason,
+			})
+			continue
+		}
+		data, err := marshalSlice(from.Pkg, v.Macaroons, format, origin.makeMacaroons)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s %v", check, from.Name, err))
+			r.add(check, from.Name, Result{
+				Outcome: OutcomeFail,
+				Reason:  err.Error(),
+			})
+			continue
+		}
+		unreadable := sliceUnreadable(data, format)
+		for _, to := range r.Impls {
+			if d, ok := r.KnownDivergence(to.Name, unreadable); ok {
+				r.add(check, to.Name, Result{
+					Outcome: OutcomeDivergent,
+					Reason:  d.Reason,
+				})
+				continue
+			}
+			if err := verifySlice(to.Pkg, data, format, []byte(v.Macaroons[0].RootKey), checker, len(v.Macaroons)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s %v", check, to.Name, err))
+				r.add(check, to.Name, Result{
+					Outcome: OutcomeFail,
+					Reason:  err.Error(),
+				})
+				continue
+			}
+			r.add(check, to.Name, Result{Outcome: OutcomePass})
+		}
+	}
+	return errs
+}
+
+// sliceUnreadable returns the behaviours that prevent an
+// implementation from unmarshaling the given slice, which
+// depend on the versions of the macaroons in it. If the
+// versions cannot be determined, it returns only the
+// behaviours implied by the format.
+func sliceUnreadable(data []byte, format Format) []Behaviour {
+	if format == FormatBinary {
+		if len(data) > 0 && data[0] == 2 {
+			// Version 2 binary macaroons start with their
+			// version number; version 1 macaroons start
+			// with a hex packet length.
+			return []Behaviour{BehaviourNoBinary, BehaviourNoJSONV2}
+		}
+		return []Behaviour{BehaviourNoBinary}
+	}
+	var s []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil
+	}
+	var bs []Behaviour
+	v1, v2 := false, false
+	for _, m := range s {
+		// Only the version 1 JSON format has a signature field.
+		if _, ok := m["signature"]; ok {
+			v1 = true
+		} else {
+			v2 = true
+		}
+	}
+	if v1 {
+		bs = append(bs, BehaviourNoJSONV1)
+	}
+	if v2 {
+		bs = append(bs, BehaviourNoJSONV2)
+	}
+	return bs
+}
+
+// marshalSlice creates the given macaroons with the given package
+// using makeMacaroons and marshals them as a slice in the given
+// format.
+func marshalSlice(pkg Package, mspecs []MacaroonSpec, format Format, makeMacaroons func(Package, []MacaroonSpec) ([]byte, []Macaroon, error)) ([]byte, error) {
+	_, macaroons, err := makeMacaroons(pkg, mspecs)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer FreeAll(macaroons)
+	data, err := pkg.MarshalSlice(macaroons, format)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot marshal slice")
+	}
+	return data, nil
+}
+
+// verifySlice unmarshals the given slice with the given package
+// and verifies the first macaroon in it with the rest as
+// discharges.
+func verifySlice(pkg Package, data []byte, format Format, rootKey []byte, check Checker, n int) error {
+	macaroons, err := pkg.UnmarshalSlice(data, format)
+	if err != nil {
+		return errgo.Notef(err, "cannot unmarshal slice")
+	}
+	defer FreeAll(macaroons)
+	if len(macaroons) != n {
+		return errgo.Newf("got %d macaroons in slice, want %d", len(macaroons), n)
+	}
+	if err := macaroons[0].Verify(rootKey, check, macaroons[1:]); err != nil {
+		return errgo.Notef(err, "cannot verify macaroons from slice")
+	}
+	return nil
+}
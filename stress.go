@@ -0,0 +1,323 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// StressCase holds pathological macaroons that are used
+// to check how implementations cope with expensive input.
+type StressCase struct {
+	Name string
+
+	// Macaroons holds the primary macaroon followed
+	// by its discharges, as in VerifyVector.
+	Macaroons []MacaroonSpec
+
+	// Conditions holds the first party conditions
+	// that are satisfied.
+	Conditions Conditions
+}
+
+// StressBudget holds the resources that an implementation
+// may use to verify the macaroons in a stress case.
+type StressBudget struct {
+	// Time holds the maximum time that verification may take.
+	Time time.Duration
+
+	// Memory holds the maximum amount of memory in bytes
+	// that may be used by verification, measured as the
+	// increase in the peak resident set size of the process
+	// that runs the implementation (the interpreter process,
+	// or the current process for Go implementations).
+	Memory int64
+}
+
+// DefaultStressBudget holds the budget used by default
+// for each stress case.
+var DefaultStressBudget = StressBudget{
+	Time:   10 * time.Second,
+	Memory: 512 * 1024 * 1024,
+}
+
+// StressCases returns the stress cases that are run by RunStress.
+func StressCases() []StressCase {
+	satisfied := Conditions{"ok": true}
+	var cases []StressCase
+
+	// Many first party caveats.
+	m := MacaroonSpec{
+		RootKey: "root-key",
+		Id:      "root-id",
+	}
+	for i := 0; i < 5000; i++ {
+		m.Caveats = append(m.Caveats, CaveatSpec{Condition: "ok"})
+	}
+	cases = append(cases, StressCase{
+		Name:       "5000 first party caveats",
+		Macaroons:  []MacaroonSpec{m},
+		Conditions: satisfied,
+	})
+
+	// A huge caveat condition.
+	cases = append(cases, StressCase{
+		Name: "256KB caveat condition",
+		Macaroons: []MacaroonSpec{{
+			RootKey: "root-key",
+			Id:      "root-id",
+			Caveats: []CaveatSpec{{
+				Condition: strings.Repeat("x", 256*1024),
+			}},
+		}},
+		Conditions: Conditions{strings.Repeat("x", 256*1024): true},
+	})
+
+	// Many discharges for the primary macaroon.
+	m = MacaroonSpec{
+		RootKey: "root-key",
+		Id:      "root-id",
+	}
+	ms := []MacaroonSpec{m}
+	for i := 0; i < 200; i++ {
+		cav := thirdPartyStressCaveat(i)
+		ms[0].Caveats = append(ms[0].Caveats, cav)
+		ms = append(ms, stressDischarge(cav))
+	}
+	cases = append(cases, StressCase{
+		Name:       "200 discharges",
+		Macaroons:  ms,
+		Conditions: satisfied,
+	})
+
+	// A deeply nested chain of discharges, each
+	// requiring the next.
+	ms = []MacaroonSpec{{
+		RootKey: "root-key",
+		Id:      "root-id",
+	}}
+	for i := 0; i < 100; i++ {
+		cav := thirdPartyStressCaveat(i)
+		ms[i].Caveats = append(ms[i].Caveats, cav)
+		ms = append(ms, stressDischarge(cav))
+	}
+	cases = append(cases, StressCase{
+		Name:       "discharge chain 100 deep",
+		Macaroons:  ms,
+		Conditions: satisfied,
+	})
+
+	// Two discharges that each require the other.
+	cav0, cav1 := thirdPartyStressCaveat(0), thirdPartyStressCaveat(1)
+	d0, d1 := stressDischarge(cav0), stressDischarge(cav1)
+	d0.Caveats = []CaveatSpec{cav1}
+	d1.Caveats = []CaveatSpec{cav0}
+	cases = append(cases, StressCase{
+		Name: "cyclic third party caveats",
+		Macaroons: []MacaroonSpec{{
+			RootKey: "root-key",
+			Id:      "root-id",
+			Caveats: []CaveatSpec{cav0},
+		}, d0, d1},
+		Conditions: satisfied,
+	})
+	return cases
+}
+
+func thirdPartyStressCaveat(i int) CaveatSpec {
+	return CaveatSpec{
+		Condition: fmt.Sprintf("third party caveat %d", i),
+		Location:  fmt.Sprintf("http://thirdparty%d.example.com", i),
+		RootKey:   fmt.Sprintf("third party key %d", i),
+	}
+}
+
+func stressDischarge(cav CaveatSpec) MacaroonSpec {
+	return MacaroonSpec{
+		RootKey:  cav.RootKey,
+		Id:       cav.Condition,
+		Location: cav.Location,
+		Caveats:  []CaveatSpec{{Condition: "ok"}},
+	}
+}
+
+// interpPackage is implemented by packages whose
+// implementation runs in an interpreter.
+type interpPackage interface {
+	interpreter() *interp
+}
+
+// RunStress verifies the macaroons in the given stress case with each
+// implementation, measuring the time and memory taken, and records
+// the measurements in the report. It returns an error for each
+// implementation that exceeds the budget or crashes. Whether
+// verification succeeds is recorded but is not counted as a failure.
+//
+// Creating the macaroons is not measured.
+func (r *Runner) RunStress(c StressCase, budget StressBudget) []error {
+	check := "stress: " + c.Name
+	var errs []error
+	for _, impl := range r.Impls {
+		usage, err := stressVerify(impl.Pkg, c, budget)
+		var reason string
+		if err == nil {
+			reason = usage.String()
+			switch {
+			case usage.time > budget.Time:
+				err = fmt.Errorf("exceeded time budget of %v", budget.Time)
+			case usage.memory > budget.Memory:
+				err = fmt.Errorf("exceeded memory budget of %d bytes", budget.Memory)
+			}
+		}
+		r.logf("%s: %s: %s", check, impl.Name, reason)
+		if err != nil {
+			if reason != "" {
+				err = fmt.Errorf("%v (%s)", err, reason)
+			}
+			errs = append(errs, fmt.Errorf("%s: %s %v", check, impl.Name, err))
+			r.add(check, impl.Name, Result{
+				Outcome: OutcomeFail,
+				Reason:  err.Error(),
+			})
+			continue
+		}
+		r.add(check, impl.Name, Result{
+			Outcome: OutcomePass,
+			Reason:  reason,
+		})
+	}
+	return errs
+}
+
+// stressUsage holds the resources used to verify a stress case.
+type stressUsage struct {
+	time      time.Duration
+	memory    int64
+	verifyErr error
+}
+
+func (u stressUsage) String() string {
+	s := fmt.Sprintf("%v, %.1fMB", u.time, float64(u.memory)/(1024*1024))
+	if u.verifyErr != nil {
+		s += fmt.Sprintf(", rejected: %v", u.verifyErr)
+	}
+	return s
+}
+
+// stressVerify creates the macaroons in the given stress case
+// and measures the resources used to verify them. It returns
+// an error if the macaroons cannot be created or if the
+// implementation crashes, or takes so long that it is abandoned.
+func stressVerify(pkg Package, c StressCase, budget StressBudget) (stressUsage, error) {
+	rootKey, macaroons, err := MakeMacaroons(pkg, c.Macaroons)
+	if err != nil {
+		return stressUsage{}, errgo.Mask(err)
+	}
+	defer FreeAll(macaroons)
+	verify := func() error {
+		return macaroons[0].Verify(rootKey, c.Conditions, macaroons[1:])
+	}
+	if ipkg, ok := pkg.(interpPackage); ok {
+		return stressVerifyInterp(ipkg.interpreter(), verify, budget)
+	}
+	return stressVerifyGo(verify, budget)
+}
+
+// stressVerifyInterp measures the resources used by an
+// implementation that runs in the given interpreter. The
+// interpreter is killed if it exceeds the time budget.
+// The memory used is the increase in the peak resident set
+// size of the interpreter process over its size before
+// verification.
+func stressVerifyInterp(i *interp, verify func() error, budget StressBudget) (stressUsage, error) {
+	if err := i.resetPeakMemory(); err != nil {
+		return stressUsage{}, errgo.Notef(err, "cannot reset peak memory")
+	}
+	baseline, _, err := i.memoryUsage()
+	if err != nil {
+		return stressUsage{}, errgo.Notef(err, "cannot get memory usage")
+	}
+	t0 := time.Now()
+	err = i.withTimeout(budget.Time, verify)
+	usage := stressUsage{
+		time:      time.Since(t0),
+		verifyErr: err,
+	}
+	switch errgo.Cause(err) {
+	case ErrInterpTimeout:
+		return stressUsage{}, fmt.Errorf("exceeded time budget of %v", budget.Time)
+	case ErrInterpCrashed:
+		return stressUsage{}, errgo.Mask(err)
+	}
+	_, peak, err := i.memoryUsage()
+	if err != nil {
+		return stressUsage{}, errgo.Notef(err, "cannot get memory usage")
+	}
+	usage.memory = memoryDelta(baseline, peak)
+	return usage, nil
+}
+
+// stressVerifyGo measures the resources used by a Go implementation.
+// If it exceeds the time budget, it is left running. The memory used
+// is measured in the same way as for interpreters, as the increase in
+// the peak resident set size of the current process, so it also
+// includes anything else running in the process at the same time.
+func stressVerifyGo(verify func() error, budget StressBudget) (stressUsage, error) {
+	debug.FreeOSMemory()
+	pid := os.Getpid()
+	if err := resetPeakMemory(pid); err != nil {
+		return stressUsage{}, errgo.Notef(err, "cannot reset peak memory")
+	}
+	baseline, _, err := memoryUsage(pid)
+	if err != nil {
+		return stressUsage{}, errgo.Notef(err, "cannot get memory usage")
+	}
+	type verifyResult struct {
+		err      error
+		panicked interface{}
+	}
+	done := make(chan verifyResult, 1)
+	t0 := time.Now()
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				done <- verifyResult{panicked: e}
+			}
+		}()
+		done <- verifyResult{err: verify()}
+	}()
+	var result verifyResult
+	select {
+	case result = <-done:
+	case <-time.After(budget.Time):
+		return stressUsage{}, fmt.Errorf("exceeded time budget of %v", budget.Time)
+	}
+	if result.panicked != nil {
+		return stressUsage{}, fmt.Errorf("panicked: %v", result.panicked)
+	}
+	usage := stressUsage{
+		time:      time.Since(t0),
+		verifyErr: result.err,
+	}
+	_, peak, err := memoryUsage(pid)
+	if err != nil {
+		return stressUsage{}, errgo.Notef(err, "cannot get memory usage")
+	}
+	usage.memory = memoryDelta(baseline, peak)
+	return usage, nil
+}
+
+// memoryDelta returns the increase of peak over baseline.
+func memoryDelta(baseline, peak int64) int64 {
+	if peak < baseline {
+		return 0
+	}
+	return peak - baseline
+}
@@ -0,0 +1,304 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// Tampering describes a modification to a macaroon
+// serialized in either of the JSON formats.
+type Tampering struct {
+	// Name holds the name of the modification.
+	Name string
+
+	// Authenticated holds whether the modified field is
+	// covered by the macaroon's signature. If it is, verification
+	// of the modified macaroon must fail; otherwise the
+	// modification must make no difference.
+	Authenticated bool
+
+	// Apply applies the modification to the unmarshaled JSON
+	// object in m. It returns false if the modification
+	// cannot be applied to m.
+	Apply func(m map[string]interface{}) bool
+}
+
+// Tamperings holds all the modifications made by RunTamper.
+var Tamperings = []Tampering{{
+	Name:          "flip-signature-bit",
+	Authenticated: true,
+	Apply: func(m map[string]interface{}) bool {
+		if sig, ok := m["signature"].(string); ok {
+			data, err := hex.DecodeString(sig)
+			if err != nil || len(data) == 0 {
+				return false
+			}
+			data[len(data)-1] ^= 1
+			m["signature"] = hex.EncodeToString(data)
+			return true
+		}
+		return alterField(m, map[string]func(string) string{
+			"s64": alterBase64,
+			"s":   alterBase64,
+		})
+	},
+}, {
+	Name:          "alter-caveat-id",
+	Authenticated: true,
+	Apply: func(m map[string]interface{}) bool {
+		return alterCaveatField(m, map[string]func(string) string{
+			"cid": appendX,
+			"i":   appendX,
+			"i64": alterBase64,
+		})
+	},
+}, {
+	Name:          "swap-caveats",
+	Authenticated: true,
+	Apply: func(m map[string]interface{}) bool {
+		caveats := jsonCaveats(m)
+		if len(caveats) < 2 || reflect.DeepEqual(caveats[0], caveats[1]) {
+			return false
+		}
+		caveats[0], caveats[1] = caveats[1], caveats[0]
+		return true
+	},
+}, {
+	Name:          "remove-caveat",
+	Authenticated: true,
+	Apply: func(m map[string]interface{}) bool {
+		caveats := jsonCaveats(m)
+		if len(caveats) == 0 {
+			return false
+		}
+		m[jsonCaveatsField(m)] = caveats[:len(caveats)-1]
+		return true
+	},
+}, {
+	Name:          "alter-vid",
+	Authenticated: true,
+	Apply: func(m map[string]interface{}) bool {
+		return alterCaveatField(m, map[string]func(string) string{
+			"vid": alterBase64,
+			"v64": alterBase64,
+			"v":   appendX,
+		})
+	},
+}, {
+	Name: "change-location",
+	Apply: func(m map[string]interface{}) bool {
+		field := "location"
+		if isJSONV2(m) {
+			field = "l"
+		}
+		loc, _ := m[field].(string)
+		m[field] = loc + "/elsewhere"
+		return true
+	},
+}, {
+	Name: "change-caveat-location",
+	Apply: func(m map[string]interface{}) bool {
+		return alterCaveatField(m, map[string]func(string) string{
+			"cl": appendElsewhere,
+			"l":  appendElsewhere,
+		})
+	},
+}}
+
+func appendX(s string) string {
+	return s + "x"
+}
+
+func appendElsewhere(loc string) string {
+	return loc + "/elsewhere"
+}
+
+// alterBase64 changes the first character of the base64-encoded
+// s, which changes the encoded data whichever alphabet is used.
+func alterBase64(s string) string {
+	if s[0] == 'A' {
+		return "B" + s[1:]
+	}
+	return "A" + s[1:]
+}
+
+// isJSONV2 reports whether the given unmarshaled JSON
+// macaroon is in the version 2 format.
+func isJSONV2(m map[string]interface{}) bool {
+	_, ok := m["signature"]
+	return !ok
+}
+
+// jsonCaveatsField returns the name of the field holding
+// the caveats in the given unmarshaled JSON macaroon.
+func jsonCaveatsField(m map[string]interface{}) string {
+	if isJSONV2(m) {
+		return "c"
+	}
+	return "caveats"
+}
+
+// jsonCaveats returns the caveats in the given
+// unmarshaled JSON macaroon.
+func jsonCaveats(m map[string]interface{}) []interface{} {
+	caveats, _ := m[jsonCaveatsField(m)].([]interface{})
+	return caveats
+}
+
+// alterField applies the function in fs for the first
+// field of m that has a non-empty string value, trying
+// the fields in sorted order, and reports whether there
+// was such a field. Only one of the alternative fields
+// for a value is present in any macaroon.
+func alterField(m map[string]interface{}, fs map[string]func(string) string) bool {
+	fields := make([]string, 0, len(fs))
+	for field := range fs {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if s, ok := m[field].(string); ok && s != "" {
+			m[field] = fs[field](s)
+			return true
+		}
+	}
+	return false
+}
+
+// alterCaveatField applies alterField to each caveat in turn
+// until it succeeds, and reports whether it did.
+func alterCaveatField(m map[string]interface{}, fs map[string]func(string) string) bool {
+	for _, cav := range jsonCaveats(m) {
+		cav, ok := cav.(map[string]interface{})
+		if ok && alterField(cav, fs) {
+			return true
+		}
+	}
+	return false
+}
+
+// tamper returns the result of applying t to the given
+// JSON-serialized macaroon, and whether t could be applied.
+func tamper(t Tampering, data []byte) ([]byte, bool, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, false, errgo.Notef(err, "cannot unmarshal %q", data)
+	}
+	if !t.Apply(m) {
+		return nil, false, nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, false, errgo.Mask(err)
+	}
+	return data, true, nil
+}
+
+// RunTamper checks that each implementation rejects the macaroons
+// in the given vector when any of them has been serialized as JSON
+// (in whichever format the implementation uses), modified by any of
+// the authenticated Tamperings and deserialized again, and that the
+// unauthenticated modifications make no difference. Implementations
+// that cannot verify the untampered macaroons fail the check. The
+// checker returned by VerifyVector.SuccessChecker is used.
+func (r *Runner) RunTamper(v VerifyVector) []error {
+	r = r.supporting("tamper: "+v.About, v.Macaroons...)
+	checker, ok := v.SuccessChecker()
+	if !ok {
+		return nil
+	}
+	r.logf("tamper test: %s", v.About)
+	var errs []error
+	for _, impl := range r.Impls {
+		// Check that verification succeeds without tampering so
+		// that any failure is known to be caused by the tampering.
+		ok, err := verifyMacaroons(impl.Pkg, v.Macaroons, checker, true)
+		if err == nil && !ok {
+			err = errgo.New("untampered macaroons do not verify")
+		}
+		if err != nil {
+			check := fmt.Sprintf("tamper: %s", v.About)
+			errs = append(errs, fmt.Errorf("%s: %s %v", check, impl.Name, err))
+			r.add(check, impl.Name, Result{
+				Outcome: OutcomeFail,
+				Reason:  err.Error(),
+			})
+			continue
+		}
+		for i := range v.Macaroons {
+			for _, t := range Tamperings {
+				check := fmt.Sprintf("tamper %s of macaroon %d: %s", t.Name, i, v.About)
+				applied, verifyErr, err := tamperVerify(impl.Pkg, v.Macaroons, checker, i, t)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %s %v", check, impl.Name, err))
+					r.add(check, impl.Name, Result{
+						Outcome: OutcomeFail,
+						Reason:  err.Error(),
+					})
+					continue
+				}
+				if !applied {
+					continue
+				}
+				var reason string
+				switch {
+				case verifyErr == nil && t.Authenticated:
+					reason = "accepted tampered macaroon"
+				case verifyErr != nil && !t.Authenticated:
+					reason = fmt.Sprintf("rejected macaroon with unauthenticated change: %v", verifyErr)
+				}
+				if reason == "" {
+					r.add(check, impl.Name, Result{Outcome: OutcomePass})
+					continue
+				}
+				errs = append(errs, fmt.Errorf("%s: %s %s", check, impl.Name, reason))
+				r.add(check, impl.Name, Result{
+					Outcome: OutcomeFail,
+					Reason:  reason,
+				})
+			}
+		}
+	}
+	return errs
+}
+
+// tamperVerify creates the given macaroons with the given package,
+// round trips the macaroon at the given index through JSON, modifying
+// it with t on the way, and returns the error from verifying them all
+// with the given conditions. A failure to unmarshal the modified
+// macaroon is treated as a verification failure.
+//
+// It reports false if t cannot be applied.
+func tamperVerify(pkg Package, mspecs []MacaroonSpec, check Checker, index int, t Tampering) (applied bool, verifyErr, err error) {
+	rootKey, macaroons, err := MakeMacaroons(pkg, mspecs)
+	if err != nil {
+		return false, nil, errgo.Mask(err)
+	}
+	defer FreeAll(macaroons)
+	data, err := macaroons[index].MarshalJSON()
+	if err != nil {
+		return false, nil, errgo.Notef(err, "cannot marshal")
+	}
+	data, applied, err = tamper(t, data)
+	if !applied || err != nil {
+		return false, nil, errgo.Mask(err)
+	}
+	m, err := pkg.UnmarshalJSON(data)
+	if err != nil {
+		if m != nil {
+			m.Free()
+		}
+		return true, errgo.Notef(err, "cannot unmarshal tampered macaroon"), nil
+	}
+	macaroons[index].Free()
+	macaroons[index] = m
+	return true, macaroons[0].Verify(rootKey, check, macaroons[1:]), nil
+}
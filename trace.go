@@ -0,0 +1,194 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPL, see LICENCE file for details.
+
+package macarooncompat
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// VerifyTrace is like m.Verify except that it also returns the
+// conditions that the checker was asked about, in the order in
+// which the implementation asked.
+//
+// Implementations that run in an interpreter are traced by
+// installing all the predicates as general predicates preceded by
+// one that records its argument, so conditions that would have
+// been satisfied by an exact predicate are included.
+func VerifyTrace(m Macaroon, rootKey []byte, check Checker, discharges []Macaroon) ([]string, error) {
+	trace, verifyErr, err := verifyTrace(m, rootKey, check, discharges)
+	if err != nil {
+		return nil, err
+	}
+	return trace, verifyErr
+}
+
+// verifyTrace is like VerifyTrace except that a failure to verify
+// the macaroon is returned as verifyErr, and err is returned only
+// when the verification could not be run at all, for example
+// because the interpreter crashed.
+func verifyTrace(m Macaroon, rootKey []byte, check Checker, discharges []Macaroon) (trace []string, verifyErr, err error) {
+	if t, ok := m.(verifyTracer); ok {
+		return t.verifyTrace(rootKey, check, discharges)
+	}
+	tc := &tracingChecker{
+		Checker: check,
+	}
+	verifyErr = m.Verify(rootKey, tc, discharges)
+	return tc.trace, verifyErr, nil
+}
+
+// verifyConditions implements Macaroon.VerifyConditions for
+// implementations that have no direct equivalent by tracing
+// verification with a checker that satisfies every condition.
+func verifyConditions(m Macaroon, rootKey []byte, discharges []Macaroon) ([]string, error) {
+	conds, err := VerifyTrace(m, rootKey, Predicates{{Op: OpPrefix, Arg: ""}}, discharges)
+	if err != nil {
+		return nil, err
+	}
+	return conds, nil
+}
+
+// verifyTracer is implemented by macaroons that cannot
+// be traced by wrapping the checker because they
+// do not call its Check method. Its verifyTrace method
+// returns results as for the verifyTrace function.
+type verifyTracer interface {
+	verifyTrace(rootKey []byte, check Checker, discharges []Macaroon) (trace []string, verifyErr, err error)
+}
+
+// tracingChecker records the conditions that it is asked about.
+type tracingChecker struct {
+	Checker
+	trace []string
+}
+
+// Check implements Checker.Check.
+func (c *tracingChecker) Check(cond string) error {
+	c.trace = append(c.trace, cond)
+	return c.Checker.Check(cond)
+}
+
+// traceResult holds the result of a traced verification
+// in an interpreter.
+type traceResult struct {
+	Trace []string `json:"trace"`
+	Error *string  `json:"error"`
+}
+
+// verifyError returns the error from the verification,
+// or nil if it succeeded.
+func (r traceResult) verifyError() error {
+	if r.Error != nil {
+		return errgo.New(*r.Error)
+	}
+	return nil
+}
+
+// RunTrace verifies the macaroons in the given vector with each
+// implementation, recording the conditions that its checker is asked
+// about, and checks that all implementations agree on the order of
+// the conditions up to and including the first that is not
+// satisfied. Conditions checked after that are recorded in the
+// report but are not compared, as some implementations stop at the
+// first unsatisfied condition and some check them all.
+//
+// Implementations known to exhibit any of the behaviours in a check's
+// Divergences are recorded as divergent without being compared.
+func (r *Runner) RunTrace(v VerifyVector) []error {
+	r = r.supporting("trace: "+v.About, v.Macaroons...)
+	r.logf("trace test: %s", v.About)
+	var errs []error
+	for j, vcheck := range v.Checks {
+		check := fmt.Sprintf("trace: %s (check %d)", v.About, j)
+		var ref []string
+		refImpl := Implementation("")
+		for _, impl := range r.Impls {
+			trace, err := traceMacaroons(impl.Pkg, v.Macaroons, vcheck.Checker())
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s %v", check, impl.Name, err))
+				r.add(check, impl.Name, Result{
+					Outcome: OutcomeFail,
+					Reason:  err.Error(),
+				})
+				continue
+			}
+			decisive, rest := splitTrace(trace, vcheck.Checker())
+			reason := formatTrace(decisive, rest)
+			r.logf("%s: %s: %s", check, impl.Name, reason)
+			if d, ok := r.KnownDivergence(impl.Name, vcheck.Divergences); ok {
+				r.add(check, impl.Name, Result{
+					Outcome: OutcomeDivergent,
+					Reason:  d.Reason + "; " + reason,
+				})
+				continue
+			}
+			if refImpl == "" {
+				ref, refImpl = decisive, impl.Name
+			} else if !reflect.DeepEqual(decisive, ref) {
+				reason = fmt.Sprintf("is inconsistent with %s; got %s want %s", refImpl, formatTrace(decisive, nil), formatTrace(ref, nil))
+				errs = append(errs, fmt.Errorf("%s: %s %s", check, impl.Name, reason))
+				r.add(check, impl.Name, Result{
+					Outcome: OutcomeFail,
+					Reason:  reason,
+				})
+				continue
+			}
+			r.add(check, impl.Name, Result{
+				Outcome: OutcomePass,
+				Reason:  reason,
+			})
+		}
+	}
+	return errs
+}
+
+// traceMacaroons creates the given macaroons with the given package
+// and returns the trace from verifying them with the given checker.
+// Whether or not the verification succeeds, it returns an error only
+// if the macaroons cannot be created or the verification cannot be
+// run.
+func traceMacaroons(pkg Package, mspecs []MacaroonSpec, check Checker) ([]string, error) {
+	rootKey, macaroons, err := MakeMacaroons(pkg, mspecs)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer FreeAll(macaroons)
+	trace, _, err := verifyTrace(macaroons[0], rootKey, check, macaroons[1:])
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot trace verification")
+	}
+	return trace, nil
+}
+
+// splitTrace splits the given trace after the first condition
+// that is not satisfied by check.
+func splitTrace(trace []string, check Checker) (decisive, rest []string) {
+	for i, cond := range trace {
+		if check.Check(cond) != nil {
+			return trace[:i+1], trace[i+1:]
+		}
+	}
+	return trace, nil
+}
+
+// formatTrace formats a trace as split by splitTrace.
+func formatTrace(decisive, rest []string) string {
+	s := quoteConditions(decisive)
+	if len(rest) > 0 {
+		s += " then after the first unsatisfied condition " + quoteConditions(rest)
+	}
+	return s
+}
+
+func quoteConditions(conds []string) string {
+	quoted := make([]string, len(conds))
+	for i, cond := range conds {
+		quoted[i] = fmt.Sprintf("%q", cond)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}